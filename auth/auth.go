@@ -1,16 +1,18 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
 
 	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/metrics"
 	"github.com/dedgarsites/dedgar/models"
+	"github.com/dedgarsites/dedgar/tracing"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo-contrib/session"
 	"golang.org/x/crypto/bcrypt"
@@ -37,37 +39,58 @@ var (
 func HandleGoogleCallback(c echo.Context) error {
 	state := c.QueryParam("state")
 	if state != oauthStateString {
-		fmt.Printf("invalid oauth state, expected '%s', got '%s'\n", oauthStateString, state)
+		logging.From(c).Warn("invalid oauth state")
 		return c.Redirect(http.StatusTemporaryRedirect, "/")
 	}
 
+	// Calls to Google go through the traced client so a slow callback
+	// shows where the time went.
+	ctx := context.WithValue(c.Request().Context(), oauth2.HTTPClient, tracing.Client)
+
 	code := c.QueryParam("code")
-	token, err := googleOauthConfig.Exchange(oauth2.NoContext, code)
+	token, err := googleOauthConfig.Exchange(ctx, code)
 	if err != nil {
-		fmt.Printf("Code exchange failed with '%s'\n", err)
+		logging.From(c).Error("exchanging oauth code", "err", err)
+		metrics.Login("google", false)
 		return c.Redirect(http.StatusTemporaryRedirect, "/")
 	}
 
-	response, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + token.AccessToken)
+	// The token goes in a header rather than the URL, which ends up in
+	// traces and error messages.
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://www.googleapis.com/oauth2/v2/userinfo", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	response, err := tracing.Client.Do(req)
 	if err != nil {
-		fmt.Println("error getting response")
-		fmt.Println(err)
+		logging.From(c).Error("getting google user info", "err", err)
+		return c.Redirect(http.StatusTemporaryRedirect, "/")
 	}
 
 	defer response.Body.Close()
 	contents, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		fmt.Println("error reading response")
-		fmt.Println(err)
+		logging.From(c).Error("reading google user info", "err", err)
+		metrics.Login("google", false)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if response.StatusCode != http.StatusOK {
+		logging.From(c).Error("getting google user info", "status", response.Status, "body", string(contents))
+		metrics.Login("google", false)
+		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
 	var gUser models.GoogleUser
-	err = json.Unmarshal(contents, &gUser)
-	if err != nil {
-		fmt.Println("Error Unmarshaling google user json: ", err)
+	if err := json.Unmarshal(contents, &gUser); err != nil {
+		logging.From(c).Error("unmarshaling google user info", "err", err)
+		metrics.Login("google", false)
+		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	if ok := datastores.AuthMap[gUser.Email]; ok {
+	ok := datastores.AuthMap[gUser.Email]
+	metrics.Login("google", ok)
+	if ok {
 		sess, _ := session.Get("session", c)
 		sess.Values["authenticated"] = "true"
 		sess.Values["google_logged_in"] = gUser.Email
@@ -75,7 +98,10 @@ func HandleGoogleCallback(c echo.Context) error {
 
 		return c.Render(http.StatusOK, "dashboard.html", nil)
 	}
-	return c.String(200, string(contents)+`https://www.googleapis.com/oauth2/v1/tokeninfo?access_token=`+token.AccessToken)
+	// Neither the token nor what Google said about the account goes back
+	// to the browser; the email is enough to add them to the allowed list.
+	logging.From(c).Warn("google account not allowed to log in", "email", gUser.Email)
+	return echo.NewHTTPError(http.StatusForbidden, "account not allowed")
 }
 
 // GET /login/google
@@ -87,10 +113,13 @@ func HandleGoogleLogin(c echo.Context) error {
 // POST /login
 func PostLogin(c echo.Context) error {
 	if !userFound(c.FormValue("username")) {
+		metrics.Login("password", false)
 		return c.String(http.StatusOK, "Username not found!")
 	}
 
-	if compareLogin(c.FormValue("username"), c.FormValue("password")) {
+	ok := compareLogin(c.FormValue("username"), c.FormValue("password"))
+	metrics.Login("password", ok)
+	if ok {
 		sess, _ := session.Get("session", c)
 		sess.Values["current_user"] = c.FormValue("username")
 		sess.Values["logged_in"] = "true"
@@ -104,14 +133,14 @@ func PostLogin(c echo.Context) error {
 
 // POST /register
 func PostRegister(c echo.Context) error {
-	TextBody := c.FormValue("login") + "\n" + c.FormValue("password")
-	fmt.Println(TextBody)
-
 	if userFound(c.FormValue("username")) || emailFound(c.FormValue("email")) {
 		return c.String(http.StatusOK, "Email address or username already taken, try again!")
 	}
 
-	createUser(c.FormValue("email"), c.FormValue("username"), c.FormValue("password"))
+	if err := createUser(c.FormValue("email"), c.FormValue("username"), c.FormValue("password")); err != nil {
+		logging.From(c).Error("creating user", "username", c.FormValue("username"), "err", err)
+		return c.String(http.StatusInternalServerError, "Sorry, your account could not be created. Please try again later.")
+	}
 
 	return c.Redirect(http.StatusPermanentRedirect, "/login")
 }
@@ -121,16 +150,16 @@ func HashPass(password string) (string, error) {
 	return string(bytes), err
 }
 
-func createUser(eName, uName, pWord string) {
+func createUser(eName, uName, pWord string) error {
 	hashed_pw, err := HashPass(pWord)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	new_user := models.User{Email: eName, UName: uName, Password: hashed_pw}
 	datastores.DB.NewRecord(new_user)
-	datastores.DB.Create(&new_user)
+	return datastores.DB.Create(&new_user).Error
 }
 
 func compareLogin(uName, pWord string) bool {
@@ -140,7 +169,7 @@ func compareLogin(uName, pWord string) bool {
 	datastores.DB.Where(&models.User{UName: uName}).First(&user).Scan(&found_u)
 
 	if found_u.UName == "" {
-		fmt.Println("Invalid username or password!")
+		logging.Logger.Debug("password login for unknown user", "username", uName)
 		return false
 	}
 
@@ -149,12 +178,11 @@ func compareLogin(uName, pWord string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hashedPW), []byte(pWord))
 
 	if err != nil {
-		fmt.Println("Invalid username or password!")
-		fmt.Println(err)
+		logging.Logger.Debug("password login failed", "username", uName, "err", err)
 		return false
 	}
 
-	fmt.Println("Found login combo matched!")
+	logging.Logger.Debug("password login succeeded", "username", uName)
 	return true
 }
 
@@ -164,13 +192,7 @@ func userFound(uName string) bool {
 
 	datastores.DB.Where(&models.User{UName: uName}).First(&user).Scan(&found_u)
 
-	if found_u.UName != "" {
-		fmt.Println("Username found.")
-		return true
-	}
-
-	fmt.Println("Username not found.")
-	return false
+	return found_u.UName != ""
 }
 
 func emailFound(eName string) bool {
@@ -179,11 +201,5 @@ func emailFound(eName string) bool {
 
 	datastores.DB.Where(&models.User{Email: eName}).First(&user).Scan(&found_e)
 
-	if found_e.Email != "" {
-		fmt.Printf("%s already taken!", found_e.Email)
-		return true
-	}
-
-	fmt.Printf("%s not taken!", found_e.Email)
-	return false
+	return found_e.Email != ""
 }
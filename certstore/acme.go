@@ -0,0 +1,80 @@
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig describes certificates issued by an ACME (RFC 8555) CA, such
+// as Let's Encrypt.
+type ACMEConfig struct {
+	// Domains are the only names certificates will be requested for.
+	Domains []string
+	// Email is given to the CA for expiry and problem notices.
+	Email string
+	// DirectoryURL is the CA's directory, Let's Encrypt's production one
+	// if empty. Point it at a local test CA such as Pebble in development.
+	DirectoryURL string
+	// CacheDir keeps the account key and certificates between restarts,
+	// so they aren't requested again every time.
+	CacheDir string
+	// CABundle is an optional PEM file of extra roots to trust when
+	// talking to the CA, for test servers with their own certificates.
+	CABundle string
+	// RenewBefore is how long before expiry certificates are renewed,
+	// 30 days if zero.
+	RenewBefore time.Duration
+}
+
+// NewACME returns a manager that obtains and renews certificates for
+// cfg.Domains. Its GetCertificate answers TLS-ALPN-01 challenges as long as
+// the TLS config lists acme.ALPNProto, and its HTTPHandler answers HTTP-01
+// challenges on port 80.
+func NewACME(cfg ACMEConfig) (*autocert.Manager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("acme: no domains configured")
+	}
+	if cfg.CacheDir == "" {
+		return nil, errors.New("acme: no cache directory configured")
+	}
+
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	if cfg.CABundle != "" {
+		pem, err := ioutil.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("acme: reading CA bundle: %v", err)
+		}
+		roots, _ := x509.SystemCertPool()
+		if roots == nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("acme: no certificates found in %s", cfg.CABundle)
+		}
+		client.HTTPClient = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  autocert.HostWhitelist(cfg.Domains...),
+		Cache:       autocert.DirCache(cfg.CacheDir),
+		Email:       cfg.Email,
+		RenewBefore: cfg.RenewBefore,
+		Client:      client,
+	}, nil
+}
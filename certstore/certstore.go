@@ -0,0 +1,163 @@
+package certstore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dedgarsites/dedgar/logging"
+)
+
+// ErrNoCertificate is returned by GetCertificate before a keypair has been
+// loaded.
+var ErrNoCertificate = errors.New("no certificate loaded")
+
+// Store serves a TLS keypair read from CertFile and KeyFile, reloading it
+// whenever the files change and, if Fetch is set, fetching fresh copies of
+// them every FetchInterval. Connections already established keep the
+// certificate they started with; new handshakes pick up the new one, so
+// rotation needs no restart.
+type Store struct {
+	CertFile string
+	KeyFile  string
+	// Fetch replaces the files on disk, for example by downloading them.
+	Fetch         func() error
+	FetchInterval time.Duration
+	// PollInterval is how often the files are checked for changes.
+	PollInterval time.Duration
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod fileStamp
+	keyMod  fileStamp
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func stamp(name string) (fileStamp, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func New(certFile, keyFile string) *Store {
+	return &Store{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		FetchInterval: 24 * time.Hour,
+		PollInterval:  30 * time.Second,
+	}
+}
+
+// Load reads the keypair from disk and starts serving it. If the files
+// don't hold a valid keypair the current certificate is kept.
+func (s *Store) Load() error {
+	certMod, err := stamp(s.CertFile)
+	if err != nil {
+		return err
+	}
+	keyMod, err := stamp(s.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.certMod = certMod
+	s.keyMod = keyMod
+	s.mu.Unlock()
+	return nil
+}
+
+// Refresh fetches new files, if there's a Fetch function, and loads them.
+func (s *Store) Refresh() error {
+	if s.Fetch != nil {
+		if err := s.Fetch(); err != nil {
+			return fmt.Errorf("fetching certificate: %v", err)
+		}
+	}
+	return s.Load()
+}
+
+// changed reports whether either file differs from what was last loaded.
+func (s *Store) changed() bool {
+	certMod, err := stamp(s.CertFile)
+	if err != nil {
+		return false
+	}
+	keyMod, err := stamp(s.KeyFile)
+	if err != nil {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return certMod != s.certMod || keyMod != s.keyMod
+}
+
+// Certificate returns the keypair being served, or nil if none has been
+// loaded.
+func (s *Store) Certificate() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert
+}
+
+// GetCertificate is for tls.Config.GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.Certificate(); cert != nil {
+		return cert, nil
+	}
+	return nil, ErrNoCertificate
+}
+
+// Run reloads the keypair when the files change and refreshes it every
+// FetchInterval until ctx is cancelled.
+func (s *Store) Run(ctx context.Context) {
+	poll := time.NewTicker(s.PollInterval)
+	defer poll.Stop()
+	fetch := time.NewTicker(s.FetchInterval)
+	defer fetch.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+			if !s.changed() {
+				continue
+			}
+			if err := s.Load(); err != nil {
+				logging.Logger.Error("reloading changed certificate", "err", err)
+			} else {
+				logging.Logger.Info("reloaded changed certificate")
+			}
+		case <-fetch.C:
+			if err := s.Refresh(); err != nil {
+				logging.Logger.Error("refreshing certificate", "err", err)
+			} else {
+				logging.Logger.Info("refreshed certificate")
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package certstore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dedgarsites/dedgar/logging"
+)
+
+// DefaultMonitor watches whichever certificate main sets up.
+var DefaultMonitor = NewMonitor(nil)
+
+// ChainCert describes one certificate of the served chain.
+type ChainCert struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// Status is the expiry of the served chain. NotAfter and DaysLeft are for
+// whichever certificate in the chain expires first.
+type Status struct {
+	Loaded   bool        `json:"loaded"`
+	NotAfter time.Time   `json:"not_after,omitempty"`
+	DaysLeft float64     `json:"days_left"`
+	Expired  bool        `json:"expired"`
+	Chain    []ChainCert `json:"chain,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// Monitor logs a warning as the certificate returned by Current passes each
+// of Thresholds on its way to expiring, and calls Notify, if set, the
+// first time each threshold is crossed for a certificate.
+type Monitor struct {
+	Current    func() *tls.Certificate
+	Thresholds []time.Duration
+	Interval   time.Duration
+	Notify     func(subject, body string) error
+
+	mu     sync.Mutex
+	warned map[string]bool
+}
+
+// NewMonitor warns 30, 14, 7 and 1 days before expiry, checking hourly.
+func NewMonitor(current func() *tls.Certificate) *Monitor {
+	return &Monitor{
+		Current:    current,
+		Thresholds: []time.Duration{30 * 24 * time.Hour, 14 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour},
+		Interval:   time.Hour,
+		warned:     make(map[string]bool),
+	}
+}
+
+// ParseThresholds reads a comma separated list of day counts, such as
+// "30,14,7,1".
+func ParseThresholds(days string) ([]time.Duration, error) {
+	var thresholds []time.Duration
+	for _, field := range strings.Split(days, ",") {
+		var n float64
+		if _, err := fmt.Sscan(strings.TrimSpace(field), &n); err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid threshold %q", field)
+		}
+		thresholds = append(thresholds, time.Duration(n*24*float64(time.Hour)))
+	}
+	return thresholds, nil
+}
+
+// Status parses the chain currently being served.
+func (m *Monitor) Status() Status {
+	var cert *tls.Certificate
+	if m.Current != nil {
+		cert = m.Current()
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return Status{Error: ErrNoCertificate.Error()}
+	}
+
+	status := Status{Loaded: true}
+	for _, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			status.Error = err.Error()
+			continue
+		}
+		status.Chain = append(status.Chain, ChainCert{
+			Subject:   c.Subject.String(),
+			Issuer:    c.Issuer.String(),
+			DNSNames:  c.DNSNames,
+			Serial:    c.SerialNumber.String(),
+			NotBefore: c.NotBefore,
+			NotAfter:  c.NotAfter,
+		})
+		if status.NotAfter.IsZero() || c.NotAfter.Before(status.NotAfter) {
+			status.NotAfter = c.NotAfter
+		}
+	}
+
+	left := time.Until(status.NotAfter)
+	status.DaysLeft = math.Floor(left.Hours()/24*10) / 10
+	status.Expired = left <= 0
+	return status
+}
+
+// Check warns about any threshold the certificate has crossed.
+func (m *Monitor) Check() {
+	status := m.Status()
+	if !status.Loaded {
+		logging.Logger.Warn("checking certificate expiry", "err", status.Error)
+		return
+	}
+	left := time.Until(status.NotAfter)
+
+	thresholds := append([]time.Duration{}, m.Thresholds...)
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] < thresholds[j] })
+
+	// Only the tightest threshold crossed matters; a certificate first
+	// seen with 3 days left shouldn't also warn about 30 and 14.
+	for _, threshold := range thresholds {
+		if left > threshold {
+			continue
+		}
+
+		key := status.Chain[0].Serial + " " + threshold.String()
+		m.mu.Lock()
+		warned := m.warned[key]
+		m.warned[key] = true
+		m.mu.Unlock()
+
+		msg := fmt.Sprintf("TLS certificate for %s expires %s (%.1f days left)", strings.Join(status.Chain[0].DNSNames, ", "), status.NotAfter.Format(time.RFC1123), status.DaysLeft)
+		if status.Expired {
+			msg = fmt.Sprintf("TLS certificate for %s expired %s", strings.Join(status.Chain[0].DNSNames, ", "), status.NotAfter.Format(time.RFC1123))
+		}
+		logging.Logger.Warn(msg, "not_after", status.NotAfter, "days_left", status.DaysLeft)
+
+		if !warned && m.Notify != nil {
+			if err := m.Notify("Certificate expiry warning", msg); err != nil {
+				logging.Logger.Error("sending certificate expiry warning", "err", err)
+			}
+		}
+		return
+	}
+}
+
+// Run checks the certificate every Interval until ctx is cancelled.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+
+	for {
+		m.Check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package comments
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/limiter"
+	"github.com/dedgarsites/dedgar/models"
+	"github.com/dedgarsites/dedgar/spam"
+)
+
+const (
+	maxNameLen = 100
+	maxBodyLen = 5000
+	// spamThreshold is the score at which a comment skips the moderation
+	// queue and is filed as spam instead.
+	spamThreshold = 3
+)
+
+var (
+	ErrRateLimited = errors.New("too many comments, try again later")
+	ErrEmpty       = errors.New("name and comment are required")
+	ErrTooLong     = errors.New("comment is too long")
+	ErrBadParent   = errors.New("comment being replied to does not exist")
+
+	// Five comments per address every ten minutes is plenty for a person.
+	rateLimit = limiter.New(5, 10*time.Minute)
+
+	linkPattern = regexp.MustCompile(`(?i)(https?://|www\.)[^\s"'<>]*`)
+	ownLinks    = spam.Links{Allow: []string{"dedgar.com"}}
+	spamWords   = []string{"viagra", "casino", "crypto", "bitcoin", "loan", "seo services", "backlinks", "porn"}
+)
+
+// Submit validates a new comment on postName and stores it in the
+// moderation queue. Comments that look like spam are stored with the spam
+// status so they can still be reviewed.
+func Submit(postName string, parentID uint, name, email, body, ip string) (*models.Comment, error) {
+	name = strings.TrimSpace(name)
+	body = strings.TrimSpace(body)
+
+	if name == "" || body == "" {
+		return nil, ErrEmpty
+	}
+	if len(name) > maxNameLen || len(body) > maxBodyLen {
+		return nil, ErrTooLong
+	}
+
+	if parentID != 0 {
+		var parent models.Comment
+		datastores.DB.Where(&models.Comment{PostName: postName, Status: models.CommentApproved}).First(&parent, parentID)
+		if parent.ID == 0 {
+			return nil, ErrBadParent
+		}
+	}
+
+	// Only charge the rate limit for comments that would otherwise be
+	// accepted, so a typo doesn't cost one of the address's slots.
+	if !rateLimit.Allow(ip) {
+		return nil, ErrRateLimited
+	}
+
+	comment := models.Comment{
+		PostName: postName,
+		ParentID: parentID,
+		Name:     name,
+		Email:    strings.TrimSpace(email),
+		Body:     body,
+		IP:       ip,
+		Status:   models.CommentPending,
+	}
+	if SpamScore(name+"\n"+body) >= spamThreshold {
+		comment.Status = models.CommentSpam
+	}
+
+	if err := datastores.DB.Create(&comment).Error; err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// SpamScore applies the same sort of heuristics PostContact uses: links to
+// anywhere other than dedgar.com, known spam keywords and shouting.
+func SpamScore(text string) int {
+	score := 0
+	lower := strings.ToLower(text)
+
+	links := linkPattern.FindAllString(text, -1)
+	for _, link := range links {
+		if !ownLinks.Allowed(link) {
+			score += 2
+			break
+		}
+	}
+	if len(links) > 2 {
+		score += len(links) - 2
+	}
+
+	for _, word := range spamWords {
+		if strings.Contains(lower, word) {
+			score++
+		}
+	}
+
+	letters, upper := 0, 0
+	for _, r := range text {
+		if r >= 'a' && r <= 'z' {
+			letters++
+		} else if r >= 'A' && r <= 'Z' {
+			letters++
+			upper++
+		}
+	}
+	if letters > 20 && upper*10 > letters*7 {
+		score++
+	}
+	return score
+}
+
+// Thread returns the approved comments on postName as a forest of top level
+// comments with their replies nested underneath, oldest first.
+func Thread(postName string) []*models.Comment {
+	var flat []*models.Comment
+	datastores.DB.Where(&models.Comment{PostName: postName, Status: models.CommentApproved}).Order("created_at asc").Find(&flat)
+
+	byID := make(map[uint]*models.Comment, len(flat))
+	for _, c := range flat {
+		byID[c.ID] = c
+	}
+
+	var roots []*models.Comment
+	for _, c := range flat {
+		if parent, ok := byID[c.ParentID]; ok && c.ParentID != 0 {
+			parent.Replies = append(parent.Replies, c)
+		} else {
+			roots = append(roots, c)
+		}
+	}
+	return roots
+}
+
+// Queue returns comments waiting on moderation, with suspected spam listed
+// after the regular pending comments.
+func Queue() []models.Comment {
+	var queue []models.Comment
+	datastores.DB.Where("status IN (?)", []string{models.CommentPending, models.CommentSpam}).Order("status asc, created_at asc").Find(&queue)
+	return queue
+}
+
+// SetStatus moves comment id to status, used for approving and rejecting.
+func SetStatus(id uint, status string) error {
+	switch status {
+	case models.CommentApproved, models.CommentRejected, models.CommentSpam, models.CommentPending:
+	default:
+		return errors.New("unknown comment status " + status)
+	}
+	return datastores.DB.Model(&models.Comment{}).Where("id = ?", id).Update("status", status).Error
+}
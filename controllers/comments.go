@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dedgarsites/dedgar/comments"
+	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/models"
+
+	"github.com/labstack/echo"
+)
+
+type commentForm struct {
+	ParentID uint   `json:"parent_id" form:"parent_id"`
+	Name     string `json:"name" form:"name"`
+	Email    string `json:"email" form:"email"`
+	Body     string `json:"body" form:"body"`
+}
+
+// commentStatus maps errors from comments.Submit to an HTTP status code.
+func commentStatus(err error) int {
+	switch err {
+	case comments.ErrRateLimited:
+		return http.StatusTooManyRequests
+	case comments.ErrEmpty, comments.ErrTooLong, comments.ErrBadParent:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// GET /api/post/:postname/comments
+func GetApiComments(c echo.Context) error {
+	post := c.Param("postname")
+	if _, ok := datastores.PostMap[post]; !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "post not found"})
+	}
+	return c.JSON(http.StatusOK, comments.Thread(post))
+}
+
+// POST /api/post/:postname/comments
+func PostApiComment(c echo.Context) error {
+	post := c.Param("postname")
+	if _, ok := datastores.PostMap[post]; !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "post not found"})
+	}
+
+	var form commentForm
+	if err := c.Bind(&form); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	comment, err := comments.Submit(post, form.ParentID, form.Name, form.Email, form.Body, c.RealIP())
+	if err != nil {
+		return c.JSON(commentStatus(err), map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusAccepted, comment)
+}
+
+// POST /post/:postname/comments
+func PostComment(c echo.Context) error {
+	post := c.Param("postname")
+	if _, ok := datastores.PostMap[post]; !ok {
+		return c.Render(http.StatusNotFound, "404.html", "404 Post not found")
+	}
+
+	var form commentForm
+	if err := c.Bind(&form); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if _, err := comments.Submit(post, form.ParentID, form.Name, form.Email, form.Body, c.RealIP()); err != nil {
+		return c.String(commentStatus(err), err.Error())
+	}
+	return c.Redirect(http.StatusSeeOther, "/post/"+post+"?comment=pending#comments")
+}
+
+// GET /admin/comments
+func GetAdminComments(c echo.Context) error {
+	return c.Render(http.StatusOK, "admin_comments.html", comments.Queue())
+}
+
+// GET /api/admin/comments
+func GetApiAdminComments(c echo.Context) error {
+	return c.JSON(http.StatusOK, comments.Queue())
+}
+
+// POST /admin/comments/:id/approve
+// POST /api/admin/comments/:id/approve
+func PostApproveComment(c echo.Context) error {
+	return moderateComment(c, models.CommentApproved)
+}
+
+// POST /admin/comments/:id/reject
+// POST /api/admin/comments/:id/reject
+func PostRejectComment(c echo.Context) error {
+	return moderateComment(c, models.CommentRejected)
+}
+
+func moderateComment(c echo.Context, status string) error {
+	api := strings.HasPrefix(c.Path(), "/api/")
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		if api {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid comment id"})
+		}
+		return c.String(http.StatusBadRequest, "invalid comment id")
+	}
+	if err := comments.SetStatus(uint(id), status); err != nil {
+		if api {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	if api {
+		return c.JSON(http.StatusOK, map[string]interface{}{"id": id, "status": status})
+	}
+	return c.Redirect(http.StatusSeeOther, "/admin/comments")
+}
@@ -1,9 +1,12 @@
 package controllers
 
 import (
-	"strings"
-
+	"github.com/dedgarsites/dedgar/comments"
 	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/mailer"
+	"github.com/dedgarsites/dedgar/mailqueue"
+	"github.com/dedgarsites/dedgar/spam"
 	"github.com/dedgarsites/dedgar/tree"
 
 	"github.com/labstack/echo"
@@ -11,13 +14,10 @@ import (
 
 	"github.com/gorilla/sessions"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	asession "github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ses"
-
 	"fmt"
 	"net/http"
+	"net/mail"
+	"time"
 )
 
 type filePath struct {
@@ -26,34 +26,57 @@ type filePath struct {
 
 // GET tree
 func GetTree(c echo.Context) error {
-	//ptree := tree.RootFolder
-	return c.Render(http.StatusOK, "tree.html", tree.RootFolder)
+	return renderTree(c, tree.Root())
 }
 
-// GET tree
+// GET /all/*
 func GetTreeAll(c echo.Context) error {
-	// TODO check PostMap before continuing with recursive logic
-	for i, item := range c.ParamValues() {
-		fmt.Println(i, item)
-	}
-	tempFolder := tree.RootFolder
-
-	if strings.HasSuffix(c.ParamValues()[0], "/") {
-		path := strings.Split(c.ParamValues()[0], "/")
-		for _, dir := range path {
-			foundFolder := tree.FindNode(tempFolder, dir)
-			if foundFolder.Name != "" {
-				tempFolder = foundFolder
-			}
+	name := treeParam(c)
+
+	folder, file, err := tree.Root().Resolve(name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "404 Folder not found")
+	}
+
+	if file != nil {
+		return c.Redirect(http.StatusFound, "/download/"+file.EscapedPath())
+	}
+
+	// Folders are always addressed by their canonical path, which ends in a
+	// slash so relative links inside them work.
+	if name != folder.Path {
+		target := "/all/" + folder.EscapedPath()
+		if query := c.QueryString(); query != "" {
+			target += "?" + query
 		}
+		return c.Redirect(http.StatusMovedPermanently, target)
 	}
-	if tempFolder.Name != "" {
-		return c.Render(http.StatusOK, "tree.html", tempFolder)
+	return renderTree(c, folder)
+}
+
+// renderTree renders a folder listing, as a gallery of thumbnails if asked
+// for with ?view=gallery or by default when the folder holds images or
+// videos.
+func renderTree(c echo.Context, folder *tree.Folder) error {
+	var gallery bool
+	switch c.QueryParam("view") {
+	case "gallery":
+		gallery = true
+	case "list":
+	default:
+		gallery = folder.HasMedia()
 	}
-	return c.Render(http.StatusNotFound, "e04.html", "404 Folder not found")
+
+	sess, _ := session.Get("session", c)
+	data := map[string]interface{}{
+		"Folder":  folder,
+		"Gallery": gallery,
+		"Editor":  sess.Values["authenticated"] == "true",
+	}
+	return c.Render(http.StatusOK, "tree.html", data)
 }
 
-// GET /all/*
+// GET /
 func GetMain(c echo.Context) error {
 	return c.Render(http.StatusOK, "main.html", datastores.PostMap)
 }
@@ -70,7 +93,12 @@ func GetAbout(c echo.Context) error {
 
 // GET /contact
 func GetContact(c echo.Context) error {
-	return c.Render(http.StatusOK, "contact.html", nil)
+	data := map[string]string{
+		"Honeypot":  honeypotField,
+		"TokenName": formTokenField,
+		"Token":     contactFillTime.Token(time.Now()),
+	}
+	return c.Render(http.StatusOK, "contact.html", data)
 }
 
 // GET /login
@@ -108,75 +136,71 @@ func GetApiGraph(c echo.Context) error {
 
 // POST /post-contact
 func PostContact(c echo.Context) error {
-
-	if strings.Contains(c.FormValue("message"), "http") && strings.Contains(c.FormValue("message"), "dedgar.com/") == false {
-		return c.String(http.StatusOK, "Form submitted")
+	email, err := mail.ParseAddress(c.FormValue("email"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Please enter a valid email address.")
 	}
 
-	TextBody := c.FormValue("name") + "\n" + c.FormValue("email") + "\n" + c.FormValue("message")
-
-	sess, err := asession.NewSession(&aws.Config{
-		Region: aws.String("us-west-2")},
-	)
-
-	svc := ses.New(sess)
-
-	input := &ses.SendEmailInput{
-		Destination: &ses.Destination{
-			CcAddresses: []*string{},
-			ToAddresses: []*string{
-				aws.String(datastores.Recipient),
-			},
+	sub := &spam.Submission{
+		IP: c.RealIP(),
+		Fields: map[string]string{
+			"name":    c.FormValue("name"),
+			"email":   email.Address,
+			"message": c.FormValue("message"),
 		},
-		Message: &ses.Message{
-			Body: &ses.Body{
-				Text: &ses.Content{
-					Charset: aws.String(datastores.CharSet),
-					Data:    aws.String(TextBody),
-				},
-			},
-			Subject: &ses.Content{
-				Charset: aws.String(datastores.CharSet),
-				Data:    aws.String(datastores.Subject),
-			},
+		Hidden: map[string]string{
+			honeypotField:  c.FormValue(honeypotField),
+			formTokenField: c.FormValue(formTokenField),
 		},
-		Source: aws.String(datastores.Sender),
 	}
 
-	result, err := svc.SendEmail(input)
-
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case ses.ErrCodeMessageRejected:
-				fmt.Println(ses.ErrCodeMessageRejected, aerr.Error())
-			case ses.ErrCodeMailFromDomainNotVerifiedException:
-				fmt.Println(ses.ErrCodeMailFromDomainNotVerifiedException, aerr.Error())
-			case ses.ErrCodeConfigurationSetDoesNotExistException:
-				fmt.Println(ses.ErrCodeConfigurationSetDoesNotExistException, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			fmt.Println(err.Error())
-		}
+	// Quarantined messages get the same response as delivered ones so
+	// spammers can't tell which of their attempts made it through.
+	if isSpam, verdicts := contactFilter.Check(sub); isSpam {
+		logging.From(c).Info("quarantined contact message", "reasons", spam.Reasons(verdicts))
+		quarantineContact(c, sub, verdicts)
+		return c.String(http.StatusOK, "Form submitted")
+	}
 
+	if err := saveContactMessage(c, sub.Fields["name"], sub.Fields["email"], sub.Fields["message"], sub.IP); err != nil {
+		return c.String(http.StatusInternalServerError, "Sorry, your message could not be saved. Please try again later.")
+	}
+	if err := queueContactEmail(c, sub.Fields["name"], sub.Fields["email"], sub.Fields["message"]); err != nil {
+		return c.String(http.StatusInternalServerError, "Sorry, your message could not be saved. Please try again later.")
 	}
-	fmt.Println(c.FormValue("name"))
-	fmt.Println(c.FormValue("email"))
-	fmt.Println(c.FormValue("message"))
-	fmt.Println("Email Sent to address: " + datastores.Recipient)
-	fmt.Println(result)
 	return c.String(http.StatusOK, "Form submitted")
 }
 
+// queueContactEmail hands a contact message to the outbound queue, which
+// retries delivery in the background if the mailer is unavailable.
+func queueContactEmail(c echo.Context, name, email, message string) error {
+	msg := &mailer.Message{
+		From:    datastores.Sender,
+		To:      []string{datastores.Recipient},
+		ReplyTo: email,
+		Subject: datastores.Subject,
+		Body:    name + "\n" + email + "\n" + message,
+	}
+
+	if err := mailqueue.EnqueueContext(c.Request().Context(), msg); err != nil {
+		logging.From(c).Error("queueing contact email", "err", err)
+		return err
+	}
+	return nil
+}
+
 // GET /post/:postname
 func GetPost(c echo.Context) error {
 	post := c.Param("postname")
 	if _, ok := datastores.PostMap[post]; ok {
-		return c.Render(http.StatusOK, post+".html", post)
+		data := map[string]interface{}{
+			"Post":     post,
+			"Comments": comments.Thread(post),
+			"Pending":  c.QueryParam("comment") == "pending",
+		}
+		return c.Render(http.StatusOK, post+".html", data)
 	}
-	return c.Render(http.StatusNotFound, "e04.html", "404 Post not found")
+	return c.Render(http.StatusNotFound, "404.html", "404 Post not found")
 }
 
 // GET /post
@@ -199,9 +223,9 @@ func Custom404Handler(err error, c echo.Context) {
 	}
 	errorPage := fmt.Sprintf("%d.html", code)
 	if err := c.Render(code, errorPage, code); err != nil {
-		c.Logger().Error(err)
+		logging.From(c).Error("rendering error page", "page", errorPage, "err", err)
 	}
-	c.Logger().Error(err)
+	logging.From(c).Error("handling request", "err", err)
 }
 
 func AuthMiddleware() echo.MiddlewareFunc {
@@ -212,8 +236,6 @@ func AuthMiddleware() echo.MiddlewareFunc {
 			sess, _ := session.Get("session", c)
 
 			if sess.Values["authenticated"] == "true" {
-				fmt.Println("in if block")
-				fmt.Println(sess.Values)
 				return next(c)
 			}
 			//return next(c)
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/thumbs"
+	"github.com/dedgarsites/dedgar/tree"
+
+	"github.com/labstack/echo"
+)
+
+// treeParam returns the unescaped wildcard path of a tree route. Echo hands
+// us the raw path when the request escaped characters that didn't need it.
+func treeParam(c echo.Context) string {
+	name := c.Param("*")
+	if c.Request().URL.RawPath != "" {
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			name = unescaped
+		}
+	}
+	return name
+}
+
+// GET /download/*
+func GetTreeFile(c echo.Context) error {
+	return serveTreeFile(c, treeParam(c))
+}
+
+// serveTreeFile sends the tree file name from DefaultStore.
+func serveTreeFile(c echo.Context, name string) error {
+	f, entry, err := tree.DefaultStore.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return echo.NewHTTPError(http.StatusNotFound, "404 File not found")
+		}
+		logging.From(c).Error("opening tree file", "path", name, "err", err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer f.Close()
+
+	etag := entry.ETag
+	if etag == "" {
+		etag = fmt.Sprintf(`"%x-%x"`, entry.ModTime.UnixNano(), entry.Size)
+	}
+
+	disposition := "inline"
+	if c.QueryParam("download") != "" {
+		disposition = "attachment"
+	}
+
+	header := c.Response().Header()
+	header.Set("ETag", etag)
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": path.Base(entry.Path)}))
+	header.Set("X-Content-Type-Options", "nosniff")
+
+	// ServeContent takes care of Range, If-Range, If-None-Match and
+	// If-Modified-Since, and picks a Content-Type from the extension or,
+	// failing that, the first 512 bytes.
+	http.ServeContent(c.Response(), c.Request(), path.Base(entry.Path), entry.ModTime, f)
+	return nil
+}
+
+// GET /thumb/*
+func GetTreeThumb(c echo.Context) error {
+	_, file, err := tree.Root().Resolve(treeParam(c))
+	if err != nil || file == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "404 File not found")
+	}
+
+	size, _ := strconv.Atoi(c.QueryParam("size"))
+	name, err := thumbs.Get(tree.DefaultStore, file, thumbs.ValidSize(size))
+	switch {
+	case err == thumbs.ErrUnsupported && file.IsImage():
+		// Browsers can show formats we can't decode, like SVG and WebP, so
+		// send them the original instead.
+		return c.Redirect(http.StatusFound, "/download/"+file.EscapedPath())
+	case err == thumbs.ErrUnsupported || err == thumbs.ErrTooLarge || os.IsNotExist(err):
+		return echo.NewHTTPError(http.StatusNotFound, "404 No thumbnail for this file")
+	case err != nil:
+		logging.From(c).Error("generating thumbnail", "path", file.Path, "err", err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	// The cache file name changes whenever the original does, so the
+	// thumbnail can be cached for as long as it's addressed this way.
+	c.Response().Header().Set("Cache-Control", "public, max-age=86400")
+	return c.File(name)
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/dedgarsites/dedgar/certstore"
+	"github.com/dedgarsites/dedgar/health"
+)
+
+var started = time.Now()
+
+// GET /healthz
+func GetHealthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"ok":     true,
+		"uptime": time.Since(started).Round(time.Second).String(),
+	})
+}
+
+// GET /readyz
+func GetReadyz(c echo.Context) error {
+	report := health.Check(c.Request().Context())
+	if !report.OK {
+		return c.JSON(http.StatusServiceUnavailable, report)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// GET /healthz/tls
+func GetHealthTLS(c echo.Context) error {
+	status := certstore.DefaultMonitor.Status()
+	if !status.Loaded || status.Expired {
+		return c.JSON(http.StatusServiceUnavailable, status)
+	}
+	return c.JSON(http.StatusOK, status)
+}
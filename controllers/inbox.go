@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/mailer"
+	"github.com/dedgarsites/dedgar/mailqueue"
+	"github.com/dedgarsites/dedgar/models"
+	"github.com/dedgarsites/dedgar/tracing"
+
+	"github.com/labstack/echo"
+)
+
+const inboxPageSize = 50
+
+func saveContactMessage(c echo.Context, name, email, message, ip string) error {
+	msg := models.ContactMessage{
+		Name:    name,
+		Email:   email,
+		Message: message,
+		IP:      ip,
+		Status:  models.MessageNew,
+	}
+	if err := tracing.DB(c.Request().Context(), datastores.DB).Create(&msg).Error; err != nil {
+		logging.From(c).Error("saving contact message", "err", err)
+		return err
+	}
+	return nil
+}
+
+// GET /admin/messages
+func GetInbox(c echo.Context) error {
+	status := c.QueryParam("status")
+	query := strings.TrimSpace(c.QueryParam("q"))
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	db := datastores.DB.Model(&models.ContactMessage{})
+	switch status {
+	case "":
+		db = db.Where("status NOT IN (?)", []string{models.MessageArchived, models.MessageSpam})
+	case "all":
+	default:
+		db = db.Where("status = ?", status)
+	}
+	if query != "" {
+		like := "%" + strings.ToLower(query) + "%"
+		db = db.Where("LOWER(name) LIKE ? OR LOWER(email) LIKE ? OR LOWER(message) LIKE ?", like, like, like)
+	}
+
+	var total int
+	db.Count(&total)
+
+	var messages []models.ContactMessage
+	db.Order("created_at desc").Offset((page - 1) * inboxPageSize).Limit(inboxPageSize).Find(&messages)
+
+	data := map[string]interface{}{
+		"Messages": messages,
+		"Statuses": models.MessageStatuses,
+		"Status":   status,
+		"Query":    query,
+		"Page":     page,
+		"PrevPage": page - 1,
+		"NextPage": 0,
+		"Total":    total,
+	}
+	if page*inboxPageSize < total {
+		data["NextPage"] = page + 1
+	}
+	return c.Render(http.StatusOK, "admin_messages.html", data)
+}
+
+// GET /admin/messages/:id
+func GetInboxMessage(c echo.Context) error {
+	msg, err := findContactMessage(c)
+	if err != nil {
+		return err
+	}
+	data := map[string]interface{}{
+		"Message":  msg,
+		"Statuses": models.MessageStatuses,
+		"Subject":  "Re: " + datastores.Subject,
+	}
+	return c.Render(http.StatusOK, "admin_message.html", data)
+}
+
+// POST /admin/messages/:id/reply
+func PostInboxReply(c echo.Context) error {
+	msg, err := findContactMessage(c)
+	if err != nil {
+		return err
+	}
+
+	body := strings.TrimSpace(c.FormValue("body"))
+	if body == "" {
+		return c.String(http.StatusBadRequest, "reply is empty")
+	}
+	subject := strings.TrimSpace(c.FormValue("subject"))
+	if subject == "" {
+		subject = "Re: " + datastores.Subject
+	}
+
+	reply := &mailer.Message{
+		From:    datastores.Sender,
+		To:      []string{msg.Email},
+		ReplyTo: datastores.Recipient,
+		Subject: subject,
+		Body:    body,
+	}
+	if err := mailqueue.Enqueue(reply); err != nil {
+		return c.String(http.StatusInternalServerError, "Error queueing reply: "+err.Error())
+	}
+
+	now := time.Now()
+	datastores.DB.Model(msg).Updates(map[string]interface{}{
+		"status":     models.MessageReplied,
+		"reply":      body,
+		"replied_at": &now,
+	})
+	return c.Redirect(http.StatusSeeOther, "/admin/messages/"+c.Param("id"))
+}
+
+// POST /admin/messages/:id/status
+func PostInboxStatus(c echo.Context) error {
+	msg, err := findContactMessage(c)
+	if err != nil {
+		return err
+	}
+
+	status := c.FormValue("status")
+	valid := false
+	for _, s := range models.MessageStatuses {
+		valid = valid || s == status
+	}
+	if !valid {
+		return c.String(http.StatusBadRequest, "unknown status "+status)
+	}
+
+	// A quarantined message was never emailed; rescuing it from spam
+	// releases it, and leaving it as spam confirms the filter was right.
+	if msg.Quarantined {
+		if status != models.MessageSpam {
+			if err := releaseContact(c, msg, status); err != nil {
+				return c.String(http.StatusInternalServerError, "Error releasing message: "+err.Error())
+			}
+		} else if err := confirmSpam(msg); err != nil {
+			logging.From(c).Error("confirming quarantined message as spam", "id", msg.ID, "err", err)
+			return c.String(http.StatusInternalServerError, "Error marking message as spam")
+		}
+		return c.Redirect(http.StatusSeeOther, "/admin/messages")
+	}
+
+	previous := msg.Status
+	if err := datastores.DB.Model(msg).Update("status", status).Error; err != nil {
+		logging.From(c).Error("updating message status", "id", msg.ID, "err", err)
+		return c.String(http.StatusInternalServerError, "Error updating message")
+	}
+
+	// Marking a message as spam, or rescuing one from spam, teaches the
+	// contact form's Bayes filter.
+	if status == models.MessageSpam && previous != models.MessageSpam {
+		contactBayes.Train(msg.Name+"\n"+msg.Message, true)
+	} else if previous == models.MessageSpam && status != models.MessageSpam {
+		contactBayes.Train(msg.Name+"\n"+msg.Message, false)
+	}
+	return c.Redirect(http.StatusSeeOther, "/admin/messages")
+}
+
+func findContactMessage(c echo.Context) (*models.ContactMessage, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid message id")
+	}
+
+	var msg models.ContactMessage
+	datastores.DB.First(&msg, id)
+	if msg.ID == 0 {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "message not found")
+	}
+	return &msg, nil
+}
@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/dedgarsites/dedgar/mailqueue"
+
+	"github.com/labstack/echo"
+)
+
+// GET /admin/mail
+func GetMailQueue(c echo.Context) error {
+	return c.Render(http.StatusOK, "admin_mail.html", mailqueue.Outstanding())
+}
+
+// POST /admin/mail/:id/retry
+func PostRetryMail(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "invalid message id")
+	}
+	if err := mailqueue.Retry(uint(id)); err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.Redirect(http.StatusSeeOther, "/admin/mail")
+}
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/limiter"
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/models"
+	"github.com/dedgarsites/dedgar/spam"
+	"github.com/dedgarsites/dedgar/tracing"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	honeypotField  = "website"
+	formTokenField = "form_token"
+)
+
+var (
+	contactFillTime = spam.FillTime{
+		Field:  formTokenField,
+		Secret: []byte(datastores.CookieSecret),
+		Min:    3 * time.Second,
+		Max:    24 * time.Hour,
+	}
+	contactBayes  = spam.NewBayes(5, 10)
+	contactFilter = spam.Chain{
+		Threshold: 5,
+		Filters: []spam.Filter{
+			spam.Honeypot{Field: honeypotField},
+			contactFillTime,
+			spam.Links{Max: 0, Allow: []string{"dedgar.com"}, Each: 5},
+			spam.Keywords{Weights: map[string]float64{
+				"seo":          2,
+				"backlinks":    3,
+				"rank your":    3,
+				"casino":       3,
+				"viagra":       5,
+				"crypto":       2,
+				"bitcoin":      2,
+				"investment":   1,
+				"unsubscribe":  2,
+				"web design":   1,
+				"marketing":    1,
+				"dear sir":     2,
+				"limited time": 2,
+			}},
+			contactBayes,
+			spam.RateLimit{Limiter: limiter.New(3, 10*time.Minute)},
+		},
+	}
+)
+
+// TrainContactFilter feeds contact messages that have already been reviewed
+// to the Bayes filter, so it doesn't start from nothing on every restart.
+// Spam still waiting in quarantine is left out, since nobody has confirmed
+// it yet.
+func TrainContactFilter() {
+	var reviewed []models.ContactMessage
+	datastores.DB.Where("quarantined = ?", false).Find(&reviewed)
+
+	for _, msg := range reviewed {
+		contactBayes.Train(msg.Name+"\n"+msg.Message, msg.Status == models.MessageSpam)
+	}
+}
+
+// quarantineContact stores a submission the filter caught as spam, without
+// emailing it.
+func quarantineContact(c echo.Context, sub *spam.Submission, verdicts []spam.Verdict) {
+	msg := models.ContactMessage{
+		Name:        sub.Fields["name"],
+		Email:       sub.Fields["email"],
+		Message:     sub.Fields["message"],
+		IP:          sub.IP,
+		Status:      models.MessageSpam,
+		Quarantined: true,
+		Score:       spam.Score(verdicts),
+		Reasons:     spam.Reasons(verdicts),
+	}
+	if err := tracing.DB(c.Request().Context(), datastores.DB).Create(&msg).Error; err != nil {
+		logging.From(c).Error("quarantining contact message", "err", err)
+	}
+}
+
+// releaseContact emails a quarantined message that turned out not to be
+// spam, as would have happened had the filter let it through, and moves it
+// to status.
+func releaseContact(c echo.Context, msg *models.ContactMessage, status string) error {
+	if err := queueContactEmail(c, msg.Name, msg.Email, msg.Message); err != nil {
+		return err
+	}
+	if err := datastores.DB.Model(msg).Updates(map[string]interface{}{
+		"status":      status,
+		"quarantined": false,
+	}).Error; err != nil {
+		return err
+	}
+	contactBayes.Train(msg.Name+"\n"+msg.Message, false)
+	return nil
+}
+
+// GET /admin/quarantine
+func GetQuarantine(c echo.Context) error {
+	var held []models.ContactMessage
+	datastores.DB.Where("quarantined = ?", true).Order("created_at desc").Find(&held)
+	return c.Render(http.StatusOK, "admin_quarantine.html", held)
+}
+
+// POST /admin/quarantine/:id/release
+func PostReleaseQuarantine(c echo.Context) error {
+	msg, err := findQuarantined(c)
+	if err != nil {
+		return err
+	}
+
+	if err := releaseContact(c, msg, models.MessageNew); err != nil {
+		return c.String(http.StatusInternalServerError, "Error releasing message: "+err.Error())
+	}
+	return c.Redirect(http.StatusSeeOther, "/admin/quarantine")
+}
+
+// POST /admin/quarantine/:id/spam
+//
+// Confirms the filter was right. The message stays in the inbox under the
+// spam status, and the Bayes filter learns from it.
+func PostConfirmSpam(c echo.Context) error {
+	msg, err := findQuarantined(c)
+	if err != nil {
+		return err
+	}
+
+	if err := confirmSpam(msg); err != nil {
+		logging.From(c).Error("confirming quarantined message as spam", "id", msg.ID, "err", err)
+		return c.String(http.StatusInternalServerError, "Error marking message as spam")
+	}
+	return c.Redirect(http.StatusSeeOther, "/admin/quarantine")
+}
+
+// confirmSpam takes a quarantined message out of quarantine as spam and
+// trains the filter on it, once that's been saved.
+func confirmSpam(msg *models.ContactMessage) error {
+	if err := datastores.DB.Model(msg).Update("quarantined", false).Error; err != nil {
+		return err
+	}
+	contactBayes.Train(msg.Name+"\n"+msg.Message, true)
+	return nil
+}
+
+func findQuarantined(c echo.Context) (*models.ContactMessage, error) {
+	msg, err := findContactMessage(c)
+	if err != nil {
+		return nil, err
+	}
+	if !msg.Quarantined {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "message not found")
+	}
+	return msg, nil
+}
@@ -0,0 +1,337 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/models"
+	"github.com/dedgarsites/dedgar/shares"
+	"github.com/dedgarsites/dedgar/tree"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+// shareEntry is one row of a shared folder listing.
+type shareEntry struct {
+	Name     string
+	URL      string
+	IsFolder bool
+	Size     string
+	ModTime  time.Time
+}
+
+type shareForm struct {
+	Path         string `json:"path" form:"path"`
+	Expires      string `json:"expires" form:"expires"`
+	Password     string `json:"password" form:"password"`
+	MaxDownloads int    `json:"max_downloads" form:"max_downloads"`
+}
+
+// shareURL is the absolute address of link, to hand to whoever it's for.
+func shareURL(c echo.Context, link *models.ShareLink) string {
+	return c.Scheme() + "://" + c.Request().Host + "/s/" + shares.Token(link) + "/"
+}
+
+func shareError(err error) error {
+	if err == shares.ErrExpired || err == shares.ErrExhausted {
+		return echo.NewHTTPError(http.StatusGone, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusNotFound, "404 Share link not found")
+}
+
+func shareUnlocked(c echo.Context, link *models.ShareLink) bool {
+	if link.PasswordHash == "" {
+		return true
+	}
+	sess, _ := session.Get("session", c)
+	return sess.Values["share_"+link.Key] == "unlocked"
+}
+
+// GET /s/:token
+func GetShareRoot(c echo.Context) error {
+	return c.Redirect(http.StatusMovedPermanently, "/s/"+url.PathEscape(c.Param("token"))+"/")
+}
+
+// GET /s/:token/*
+//
+// Lists a shared folder, or sends one of the files in it. Links to a single
+// file list just that file. A file counts against the link's download limit
+// once per session, and only for requests that get sent its first byte;
+// range requests that carry on from part way through don't count.
+func GetShare(c echo.Context) error {
+	token := c.Param("token")
+	link, err := shares.Find(token)
+	if err != nil {
+		return shareError(err)
+	}
+	if !shareUnlocked(c, link) {
+		return c.Render(http.StatusUnauthorized, "share_password.html", map[string]string{"Token": token})
+	}
+
+	sub := treeParam(c)
+	name := link.Path + sub
+	if !strings.HasSuffix(link.Path, "/") {
+		name = link.Path
+		if sub == "" {
+			name = parentDir(link.Path)
+		} else if sub != path.Base(link.Path) {
+			return echo.NewHTTPError(http.StatusNotFound, "404 File not found")
+		}
+	}
+
+	folder, file, err := tree.Root().Resolve(name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "404 File not found")
+	}
+
+	prefix := "/s/" + url.PathEscape(token) + "/"
+	if file != nil {
+		if !shares.Contains(link, file.Path) {
+			return echo.NewHTTPError(http.StatusNotFound, "404 File not found")
+		}
+		if req := c.Request(); req.Method == http.MethodGet && sendsStart(req.Header, file.Size) {
+			sess, _ := session.Get("session", c)
+			key := "share_" + link.Key + "_" + file.ID
+			if sess.Values[key] == nil {
+				if err := shares.CountDownload(link); err != nil {
+					return shareError(err)
+				}
+				// The download's been counted either way, so a session
+				// that can't be saved just means the next one counts too.
+				sess.Values[key] = "downloaded"
+				if err := sess.Save(req, c.Response()); err != nil {
+					logging.From(c).Error("saving share session", "share", link.ID, "err", err)
+				}
+			}
+		}
+		return serveTreeFile(c, file.Path)
+	}
+
+	if sub != "" && !strings.HasSuffix(sub, "/") {
+		return c.Redirect(http.StatusMovedPermanently, prefix+(&url.URL{Path: sub}).EscapedPath()+"/")
+	}
+
+	title := path.Base(strings.TrimSuffix(name, "/"))
+	var entries []shareEntry
+	if !strings.HasSuffix(link.Path, "/") {
+		title = path.Base(link.Path)
+		for _, f := range folder.Files {
+			if f.Path == link.Path {
+				entries = append(entries, shareEntry{Name: f.Name, URL: prefix + (&url.URL{Path: f.Name}).EscapedPath(), Size: f.HumanSize(), ModTime: f.ModTime})
+			}
+		}
+	} else {
+		for _, f := range folder.Subfolders() {
+			rel := strings.TrimPrefix(f.Path, link.Path)
+			entries = append(entries, shareEntry{Name: f.Name + "/", URL: prefix + (&url.URL{Path: rel}).EscapedPath(), IsFolder: true, Size: f.HumanSize(), ModTime: f.ModTime})
+		}
+		for _, f := range folder.Files {
+			rel := strings.TrimPrefix(f.Path, link.Path)
+			entries = append(entries, shareEntry{Name: f.Name, URL: prefix + (&url.URL{Path: rel}).EscapedPath(), Size: f.HumanSize(), ModTime: f.ModTime})
+		}
+	}
+
+	data := map[string]interface{}{
+		"Name":    title,
+		"Entries": entries,
+		"Parent":  "",
+		"Expires": link.ExpiresAt,
+	}
+	if sub != "" {
+		data["Parent"] = prefix + (&url.URL{Path: parentDir(sub)}).EscapedPath()
+	}
+	return c.Render(http.StatusOK, "share.html", data)
+}
+
+// sendsStart reports whether http.ServeContent will send the first byte of a
+// file of the given size for a request with header h, which is when a share
+// download counts. It errs towards true: an If-Range header, which makes
+// ServeContent send the whole file unless it matches, or a Range header it
+// can't make sense of both count.
+func sendsStart(h http.Header, size int64) bool {
+	rng := h.Get("Range")
+	if rng == "" || h.Get("If-Range") != "" || !strings.HasPrefix(rng, "bytes=") {
+		return true
+	}
+
+	var total int64
+	for _, spec := range strings.Split(strings.TrimPrefix(rng, "bytes="), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return true
+		}
+		start, end := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+		if start == "" {
+			// A suffix range, for the last n bytes.
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n >= size {
+				return true
+			}
+			total += n
+			continue
+		}
+		first, err := strconv.ParseInt(start, 10, 64)
+		if err != nil || first == 0 {
+			return true
+		}
+		if first >= size {
+			// ServeContent skips ranges past the end.
+			continue
+		}
+		last := size - 1
+		if end != "" {
+			if last, err = strconv.ParseInt(end, 10, 64); err != nil {
+				return true
+			}
+			if last >= size {
+				last = size - 1
+			}
+		}
+		total += last - first + 1
+	}
+	// Ranges adding up to more than the file get the whole file instead.
+	return total > size
+}
+
+// parentDir returns the folder above the slash terminated folder path p,
+// also slash terminated, or "" at the top.
+func parentDir(p string) string {
+	dir := path.Dir(strings.TrimSuffix(p, "/"))
+	if dir == "." {
+		return ""
+	}
+	return dir + "/"
+}
+
+// POST /s/:token
+func PostShareUnlock(c echo.Context) error {
+	token := c.Param("token")
+	link, err := shares.Find(token)
+	if err != nil {
+		return shareError(err)
+	}
+
+	if err := shares.CheckPassword(link, c.FormValue("password"), c.RealIP()); err != nil {
+		code := http.StatusUnauthorized
+		if err == shares.ErrRateLimited {
+			code = http.StatusTooManyRequests
+		}
+		return c.Render(code, "share_password.html", map[string]string{"Token": token, "Error": err.Error()})
+	}
+
+	sess, _ := session.Get("session", c)
+	sess.Values["share_"+link.Key] = "unlocked"
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		logging.From(c).Error("saving share session", "share", link.ID, "err", err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return c.Redirect(http.StatusSeeOther, "/s/"+url.PathEscape(token)+"/")
+}
+
+// GET /admin/shares
+func GetAdminShares(c echo.Context) error {
+	data := map[string]interface{}{
+		"Links": shareList(c),
+		"Path":  c.QueryParam("path"),
+	}
+	return c.Render(http.StatusOK, "admin_shares.html", data)
+}
+
+// GET /api/admin/shares
+func GetApiAdminShares(c echo.Context) error {
+	return c.JSON(http.StatusOK, shareList(c))
+}
+
+func shareList(c echo.Context) []map[string]interface{} {
+	var list []map[string]interface{}
+	for _, link := range shares.Active() {
+		list = append(list, shareInfo(c, &link))
+	}
+	return list
+}
+
+func shareInfo(c echo.Context, link *models.ShareLink) map[string]interface{} {
+	return map[string]interface{}{
+		"id":            link.ID,
+		"path":          link.Path,
+		"url":           shareURL(c, link),
+		"expires_at":    link.ExpiresAt,
+		"password":      link.PasswordHash != "",
+		"max_downloads": link.MaxDownloads,
+		"downloads":     link.Downloads,
+		"created_by":    link.CreatedBy,
+		"created_at":    link.CreatedAt,
+	}
+}
+
+// POST /admin/shares
+// POST /api/admin/shares
+//
+// Takes the tree "path" to share, "expires", a duration such as "168h",
+// and optionally a "password" and "max_downloads".
+func PostShare(c echo.Context) error {
+	api := strings.HasPrefix(c.Path(), "/api/")
+
+	var form shareForm
+	if err := c.Bind(&form); err != nil {
+		return shareCreateError(c, api, http.StatusBadRequest, err)
+	}
+	lifetime, err := time.ParseDuration(form.Expires)
+	if err != nil {
+		return shareCreateError(c, api, http.StatusBadRequest, shares.ErrBadLifetime)
+	}
+
+	link, err := shares.Create(form.Path, lifetime, form.Password, form.MaxDownloads, treeEditor(c))
+	switch {
+	case err == tree.ErrNotFound:
+		return shareCreateError(c, api, http.StatusNotFound, err)
+	case err == shares.ErrBadLifetime || err == shares.ErrBadDownloads || err == shares.ErrRoot:
+		return shareCreateError(c, api, http.StatusBadRequest, err)
+	case err != nil:
+		logging.From(c).Error("creating share link", "path", form.Path, "err", err)
+		return shareCreateError(c, api, http.StatusInternalServerError, err)
+	}
+
+	if api {
+		return c.JSON(http.StatusCreated, shareInfo(c, link))
+	}
+	return c.Redirect(http.StatusSeeOther, "/admin/shares")
+}
+
+func shareCreateError(c echo.Context, api bool, code int, err error) error {
+	if api {
+		return c.JSON(code, map[string]string{"error": err.Error()})
+	}
+	return c.String(code, err.Error())
+}
+
+// POST /admin/shares/:id/revoke
+// POST /api/admin/shares/:id/revoke
+func PostRevokeShare(c echo.Context) error {
+	api := strings.HasPrefix(c.Path(), "/api/")
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return shareCreateError(c, api, http.StatusBadRequest, fmt.Errorf("invalid share id"))
+	}
+	if err := shares.Revoke(uint(id)); err != nil {
+		return shareCreateError(c, api, http.StatusInternalServerError, err)
+	}
+
+	if api {
+		return c.JSON(http.StatusOK, map[string]interface{}{"id": id, "revoked": true})
+	}
+	return c.Redirect(http.StatusSeeOther, "/admin/shares")
+}
@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dedgarsites/dedgar/tree"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultTreePageSize = 100
+	maxTreePageSize     = 1000
+	maxTreeDepth        = 10
+	maxSearchResults    = 1000
+	searchTimeout       = 5 * time.Second
+)
+
+// GET /api/tree/*
+//
+// Query parameters: sort (name, size or mtime), order (asc or desc), page,
+// per_page and depth, the number of levels of subfolder contents to nest.
+// With q set, the folder is searched instead; see searchTree.
+func GetApiTree(c echo.Context) error {
+	folder, file, err := tree.Root().Resolve(treeParam(c))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "not found"})
+	}
+	if file != nil {
+		return c.JSON(http.StatusOK, file.Item())
+	}
+	if c.QueryParam("q") != "" {
+		return searchTree(c, folder)
+	}
+
+	opts := tree.ListOptions{Sort: c.QueryParam("sort")}
+	if opts.Sort == "" {
+		opts.Sort = "name"
+	}
+	valid := false
+	for _, key := range tree.SortKeys {
+		valid = valid || key == opts.Sort
+	}
+	if !valid {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "sort must be one of name, size or mtime"})
+	}
+
+	switch c.QueryParam("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "order must be asc or desc"})
+	}
+
+	page, err := intParam(c, "page", 1, 1, 1<<30)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	perPage, err := intParam(c, "per_page", defaultTreePageSize, 1, maxTreePageSize)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	opts.Depth, err = intParam(c, "depth", 0, 0, maxTreeDepth)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	opts.Offset = (page - 1) * perPage
+	opts.Limit = perPage
+
+	items, total := folder.List(opts)
+	if items == nil {
+		items = []tree.Item{}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"folder":   folder.Item(),
+		"items":    items,
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+	})
+}
+
+// searchTree finds everything under folder whose name matches q, a glob
+// like "*.jpg" or a plain substring. type narrows the results to "file" or
+// "folder" and limit caps how many are returned.
+func searchTree(c echo.Context, folder *tree.Folder) error {
+	opts := tree.SearchOptions{Pattern: c.QueryParam("q"), Type: c.QueryParam("type")}
+	switch opts.Type {
+	case "", "file", "folder":
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "type must be file or folder"})
+	}
+
+	var err error
+	opts.Limit, err = intParam(c, "limit", maxSearchResults, 1, maxSearchResults)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), searchTimeout)
+	defer cancel()
+
+	items, err := folder.Search(ctx, opts)
+	switch {
+	case err == context.DeadlineExceeded:
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "search took too long"})
+	case err == context.Canceled:
+		return nil
+	case err != nil:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid pattern"})
+	}
+	if items == nil {
+		items = []tree.Item{}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"folder": folder.Item(),
+		"query":  opts.Pattern,
+		"items":  items,
+		"total":  len(items),
+	})
+}
+
+// intParam reads an integer query parameter, using def when it is missing
+// and rejecting values outside min and max.
+func intParam(c echo.Context, name string, def, min, max int) (int, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%s must be a number between %d and %d", name, min, max)
+	}
+	return n, nil
+}
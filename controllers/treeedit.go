@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/models"
+	"github.com/dedgarsites/dedgar/tree"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+// Tree edits are served under /admin/tree for the HTML listing, which
+// redirects back to the folder, and under /api/admin/tree for scripts, which
+// get JSON. Both sit behind AuthMiddleware.
+
+type treeEditForm struct {
+	Path string `json:"path" form:"path"`
+	To   string `json:"to" form:"to"`
+	Name string `json:"name" form:"name"`
+	Size int64  `json:"size" form:"size"`
+}
+
+func treeEditStatus(err error) int {
+	if _, ok := err.(*tree.OffsetError); ok {
+		return http.StatusConflict
+	}
+	switch {
+	case err == tree.ErrReadOnly:
+		return http.StatusForbidden
+	case err == tree.ErrNotFound || err == tree.ErrUploadNotFound || os.IsNotExist(err):
+		return http.StatusNotFound
+	case err == tree.ErrExists || err == tree.ErrIntoItself || os.IsExist(err):
+		return http.StatusConflict
+	case err == tree.ErrTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case err == os.ErrInvalid:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func treeEditError(c echo.Context, api bool, err error) error {
+	code := treeEditStatus(err)
+	if code == http.StatusInternalServerError {
+		logging.From(c).Error("editing file tree", "err", err)
+	}
+
+	// Store errors can name filesystem paths and buckets, which only belong
+	// in the log.
+	msg := err.Error()
+	switch err.(type) {
+	case *os.PathError, *os.LinkError:
+		msg = http.StatusText(code)
+	}
+	if err == os.ErrInvalid {
+		msg = "invalid path"
+	} else if code == http.StatusInternalServerError {
+		msg = http.StatusText(code)
+	}
+	if api {
+		body := map[string]interface{}{"error": msg}
+		if oerr, ok := err.(*tree.OffsetError); ok {
+			body["offset"] = oerr.Offset
+		}
+		return c.JSON(code, body)
+	}
+	return c.String(code, msg)
+}
+
+// treeFolderURL is the listing of the folder that contains name.
+func treeFolderURL(name string) string {
+	dir := path.Dir(strings.Trim(name, "/"))
+	if dir == "." {
+		return "/all/"
+	}
+	folder := tree.Folder{Path: dir + "/"}
+	return "/all/" + folder.EscapedPath()
+}
+
+func treeEditor(c echo.Context) string {
+	sess, _ := session.Get("session", c)
+	editor, _ := sess.Values["google_logged_in"].(string)
+	return editor
+}
+
+// auditTreeChange records who made an edit. A failure to record it is
+// logged rather than undoing an edit that has already happened.
+func auditTreeChange(c echo.Context, action, name, target string, size int64) {
+	change := models.TreeChange{
+		User:   treeEditor(c),
+		Action: action,
+		Path:   name,
+		Target: target,
+		Size:   size,
+		IP:     c.RealIP(),
+	}
+	if err := datastores.DB.Create(&change).Error; err != nil {
+		logging.From(c).Error("recording tree change", "action", action, "path", name, "err", err)
+	}
+}
+
+// POST /admin/tree/upload
+// POST /api/admin/tree/upload
+//
+// Takes a multipart form with the destination "folder" and one or more
+// "file" parts.
+func PostTreeUpload(c echo.Context) error {
+	api := strings.HasPrefix(c.Path(), "/api/")
+	folder := c.FormValue("folder")
+
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["file"]) == 0 {
+		return treeEditError(c, api, os.ErrInvalid)
+	}
+
+	var items []tree.Item
+	for _, header := range form.File["file"] {
+		if header.Size > tree.MaxUploadSize {
+			return treeEditError(c, api, tree.ErrTooLarge)
+		}
+		// Some browsers send the full client side path.
+		name := path.Join(folder, path.Base(strings.Replace(header.Filename, "\\", "/", -1)))
+
+		src, err := header.Open()
+		if err != nil {
+			return treeEditError(c, api, err)
+		}
+		file, err := tree.Upload(name, src)
+		src.Close()
+		if err != nil {
+			return treeEditError(c, api, err)
+		}
+
+		auditTreeChange(c, models.TreeUpload, file.Path, "", file.Size)
+		items = append(items, file.Item())
+	}
+
+	if api {
+		return c.JSON(http.StatusCreated, items)
+	}
+	return c.Redirect(http.StatusSeeOther, treeFolderURL(items[0].Path))
+}
+
+// POST /admin/tree/mkdir
+// POST /api/admin/tree/mkdir
+func PostTreeMkdir(c echo.Context) error {
+	api := strings.HasPrefix(c.Path(), "/api/")
+
+	var form treeEditForm
+	if err := c.Bind(&form); err != nil {
+		return treeEditError(c, api, os.ErrInvalid)
+	}
+	name := path.Join(form.Path, form.Name)
+
+	folder, err := tree.Mkdir(name)
+	if err != nil {
+		return treeEditError(c, api, err)
+	}
+	auditTreeChange(c, models.TreeMkdir, folder.Path, "", 0)
+
+	if api {
+		return c.JSON(http.StatusCreated, folder.Item())
+	}
+	return c.Redirect(http.StatusSeeOther, "/all/"+folder.EscapedPath())
+}
+
+// POST /admin/tree/move
+// POST /api/admin/tree/move
+//
+// Moves "path" to "to", or renames it to "name" within the same folder.
+func PostTreeMove(c echo.Context) error {
+	api := strings.HasPrefix(c.Path(), "/api/")
+
+	var form treeEditForm
+	if err := c.Bind(&form); err != nil {
+		return treeEditError(c, api, os.ErrInvalid)
+	}
+	from := strings.Trim(form.Path, "/")
+	to := strings.Trim(form.To, "/")
+	if to == "" && form.Name != "" {
+		to = path.Join(path.Dir(from), form.Name)
+	}
+	if from == "" || to == "" || strings.Contains(form.Name, "/") {
+		return treeEditError(c, api, os.ErrInvalid)
+	}
+
+	if err := tree.Move(from, to); err != nil {
+		return treeEditError(c, api, err)
+	}
+	auditTreeChange(c, models.TreeMove, from, to, 0)
+
+	if api {
+		return c.JSON(http.StatusOK, map[string]string{"from": from, "to": to})
+	}
+	return c.Redirect(http.StatusSeeOther, treeFolderURL(to))
+}
+
+// POST /admin/tree/delete
+// POST /api/admin/tree/delete
+func PostTreeDelete(c echo.Context) error {
+	api := strings.HasPrefix(c.Path(), "/api/")
+
+	var form treeEditForm
+	if err := c.Bind(&form); err != nil {
+		return treeEditError(c, api, os.ErrInvalid)
+	}
+	name := strings.Trim(form.Path, "/")
+
+	if err := tree.Delete(name); err != nil {
+		return treeEditError(c, api, err)
+	}
+	auditTreeChange(c, models.TreeDelete, name, "", 0)
+
+	if api {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.Redirect(http.StatusSeeOther, treeFolderURL(name))
+}
+
+// POST /api/admin/tree/uploads
+//
+// Starts a resumable upload of "size" bytes to "path". The chunks are then
+// sent with PUT to the returned upload, each with an Upload-Offset header
+// saying where in the file it starts.
+func PostTreeChunkedUpload(c echo.Context) error {
+	var form treeEditForm
+	if err := c.Bind(&form); err != nil {
+		return treeEditError(c, true, os.ErrInvalid)
+	}
+
+	upload, err := tree.StartUpload(form.Path, form.Size)
+	if err != nil {
+		return treeEditError(c, true, err)
+	}
+	return c.JSON(http.StatusCreated, upload)
+}
+
+// GET /api/admin/tree/uploads/:id
+//
+// Reports how much of an upload has arrived, so an interrupted one can
+// carry on from there.
+func GetTreeChunkedUpload(c echo.Context) error {
+	upload, err := tree.GetUpload(c.Param("id"))
+	if err != nil {
+		return treeEditError(c, true, err)
+	}
+	c.Response().Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	return c.JSON(http.StatusOK, upload)
+}
+
+// PUT /api/admin/tree/uploads/:id
+func PutTreeChunk(c echo.Context) error {
+	offset, err := strconv.ParseInt(c.Request().Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Upload-Offset header is required"})
+	}
+
+	upload, file, err := tree.WriteChunk(c.Param("id"), offset, c.Request().Body)
+	if err != nil {
+		return treeEditError(c, true, err)
+	}
+	c.Response().Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+	if file == nil {
+		return c.JSON(http.StatusOK, upload)
+	}
+	auditTreeChange(c, models.TreeUpload, file.Path, "", file.Size)
+	return c.JSON(http.StatusCreated, file.Item())
+}
+
+// DELETE /api/admin/tree/uploads/:id
+func DeleteTreeChunkedUpload(c echo.Context) error {
+	if err := tree.CancelUpload(c.Param("id")); err != nil {
+		return treeEditError(c, true, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -3,19 +3,23 @@ package datastores
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/dedgarsites/dedgar/logging"
 	"github.com/dedgarsites/dedgar/models"
 	"github.com/jinzhu/gorm"
 
 	// Convention for gorm usage
-	_ "github.com/jinzhu/gorm/dialects/mysql"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
 
 var (
@@ -34,10 +38,64 @@ var (
 	Sender       string
 	Recipient    string
 	AuthMap      map[string]bool
-	psqlInfo     = fmt.Sprintf("host=%s port=%s user=%s "+"password=%s dbname=%s sslmode=disable", dbHost, dbPort, dbUser, dbPass, dbName)
-	DB, _        = gorm.Open("postgres", psqlInfo)
+	MailerConfig models.MailerSecrets
+	// DB is never nil, but until Connect has succeeded queries against it
+	// fail rather than reaching the database.
+	DB *gorm.DB
+	// ConnectRetry is how long Connect waits between attempts.
+	ConnectRetry = 5 * time.Second
+
+	connected int32
 )
 
+// open sets up DB for the database named in the secrets. The server may
+// not be up yet; database/sql connects lazily, so DB starts working as
+// soon as it is.
+func open() {
+	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s "+"password=%s dbname=%s sslmode=disable", dbHost, dbPort, dbUser, dbPass, dbName)
+
+	sqlDB, err := sql.Open("postgres", psqlInfo)
+	if err != nil {
+		logging.Logger.Error("opening database", "err", err)
+	}
+	// gorm only closes connections it opened itself, so a failed ping here
+	// leaves sqlDB usable once the server comes up.
+	DB, err = gorm.Open("postgres", sqlDB)
+	if err != nil {
+		logging.Logger.Warn("database not reachable yet", "err", err)
+	}
+}
+
+// Connect pings the database every ConnectRetry until it answers, then runs
+// setup, such as creating tables, and marks the database connected. It
+// gives up if ctx is done first.
+func Connect(ctx context.Context, setup func()) {
+	ticker := time.NewTicker(ConnectRetry)
+	defer ticker.Stop()
+
+	for {
+		err := DB.DB().PingContext(ctx)
+		if err == nil {
+			setup()
+			atomic.StoreInt32(&connected, 1)
+			logging.Logger.Info("connected to database")
+			return
+		}
+		logging.Logger.Warn("waiting for database", "err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Connected reports whether Connect has succeeded.
+func Connected() bool {
+	return atomic.LoadInt32(&connected) == 1
+}
+
 func FindSummary(fpath string) string {
 	file, err := os.Open(fpath + "_summary")
 	if err != nil {
@@ -58,7 +116,8 @@ func FindSummary(fpath string) string {
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		logging.Logger.Error("reading post summary", "path", fpath, "err", err)
+		return "No summary"
 	}
 	return buffer.String()
 }
@@ -69,7 +128,7 @@ func FindSummary(fpath string) string {
 func FindPosts(dirpath string, extension string) map[string]string {
 	if err := filepath.Walk(dirpath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Println(err)
+			logging.Logger.Error("finding posts", "path", path, "err", err)
 		}
 		if strings.HasSuffix(path, extension) {
 			postname := strings.Split(path, extension)[0]
@@ -87,9 +146,29 @@ func FindPosts(dirpath string, extension string) map[string]string {
 
 func CheckDB() {
 	if !DB.HasTable(&models.User{}) {
-		fmt.Println("Creating users table")
+		logging.Logger.Info("creating table", "table", "users")
 		DB.CreateTable(&models.User{})
 	}
+	if !DB.HasTable(&models.Comment{}) {
+		logging.Logger.Info("creating table", "table", "comments")
+		DB.CreateTable(&models.Comment{})
+	}
+	if !DB.HasTable(&models.OutboundEmail{}) {
+		logging.Logger.Info("creating table", "table", "outbound_emails")
+		DB.CreateTable(&models.OutboundEmail{})
+	}
+	if !DB.HasTable(&models.ContactMessage{}) {
+		logging.Logger.Info("creating table", "table", "contact_messages")
+		DB.CreateTable(&models.ContactMessage{})
+	}
+	if !DB.HasTable(&models.TreeChange{}) {
+		logging.Logger.Info("creating table", "table", "tree_changes")
+		DB.CreateTable(&models.TreeChange{})
+	}
+	if !DB.HasTable(&models.ShareLink{}) {
+		logging.Logger.Info("creating table", "table", "share_links")
+		DB.CreateTable(&models.ShareLink{})
+	}
 }
 
 func init() {
@@ -99,12 +178,12 @@ func init() {
 	fileBytes, err := ioutil.ReadFile(filePath)
 
 	if err != nil {
-		fmt.Println("Error loading secrets json: ", err)
+		logging.Logger.Error("loading secrets json", "err", err)
 	}
 
 	err = json.Unmarshal(fileBytes, &appSecrets)
 	if err != nil {
-		fmt.Println("Error Unmarshaling secrets json: ", err)
+		logging.Logger.Error("unmarshaling secrets json", "err", err)
 	}
 
 	CookieSecret = appSecrets.CookieSecret
@@ -120,4 +199,7 @@ func init() {
 	Sender = appSecrets.Sender
 	AuthMap = appSecrets.AuthMap
 	Recipient = appSecrets.Recipient
+	MailerConfig = appSecrets.Mailer
+
+	open()
 }
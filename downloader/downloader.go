@@ -2,95 +2,343 @@ package downloader
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
-	"flag"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/tracing"
 )
 
-var (
+const (
 	clusterCABundle = "/var/run/secrets/kubernetes.io/serviceaccount/service-ca.crt"
+	// maxFileSize is far more than any certificate or key needs.
+	maxFileSize = 1 << 20
 )
 
+// Options controls how files are downloaded.
+type Options struct {
+	// Timeout limits each request.
+	Timeout time.Duration
+	// CABundle is a PEM file of roots to trust on top of the system ones.
+	// A missing file is ignored.
+	CABundle string
+	// Insecure skips verifying the server's certificate.
+	Insecure bool
+	// Attempts is how many times each file is tried, waiting Backoff after
+	// the first failure and twice as long after each one after that.
+	Attempts int
+	Backoff  time.Duration
+}
+
+// DefaultOptions trusts the cluster's service CA, which signs the
+// certificate of the download service.
+var DefaultOptions = Options{
+	Timeout:  30 * time.Second,
+	CABundle: clusterCABundle,
+	Attempts: 5,
+	Backoff:  time.Second,
+}
+
+// StatusError is returned when the server answers with anything but 200.
+type StatusError struct {
+	File   string
+	Status string
+	Code   int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("downloading %s: %s", e.File, e.Status)
+}
+
+// temporary reports whether the request is worth retrying.
+func (e *StatusError) temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+}
+
 type certFile struct {
 	FileName string `json:"FileName"`
 }
 
-// FileFromURL downloads file(s) from baseURL and writes it to the specified filePath.
-func FileFromURL(downloadURL, filePath string, fileName ...string) error {
-	insecure := flag.Bool("insecure-ssl", false, "Accept/Ignore all server SSL certificates")
-	flag.Parse()
+// FileFromURL downloads file(s) from downloadURL into filePath. Every file
+// has to be PEM, and if the files include a certificate and a private key
+// they have to belong together. Nothing is written unless all of them pass,
+// and each is renamed into place so readers never see a partial file.
+func FileFromURL(downloadURL, filePath string, opts Options, fileName ...string) error {
+	return FileFromURLContext(context.Background(), downloadURL, filePath, opts, fileName...)
+}
 
-	rootCAs, _ := x509.SystemCertPool()
-	if rootCAs == nil {
-		rootCAs = x509.NewCertPool()
-	}
+// FileFromURLContext is FileFromURL, giving up on retries once ctx is done.
+func FileFromURLContext(ctx context.Context, downloadURL, filePath string, opts Options, fileName ...string) (err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "downloader.FileFromURL",
+		trace.WithAttributes(attribute.StringSlice("files", fileName)))
+	defer func() { tracing.End(span, err) }()
 
-	certs, err := ioutil.ReadFile(clusterCABundle)
+	client, err := newClient(opts)
 	if err != nil {
-		fmt.Printf("Failed to append %q to RootCAs: %v \n", clusterCABundle, err)
+		return err
 	}
-
-	if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
-		fmt.Println("No certs appended, using system certs only")
+	if err := os.MkdirAll(filePath, 0755); err != nil {
+		return err
 	}
 
-	config := &tls.Config{
-		InsecureSkipVerify: *insecure,
-		RootCAs:            rootCAs,
-	}
-	tr := &http.Transport{TLSClientConfig: config}
+	var temps []string
+	defer func() {
+		for _, tmp := range temps {
+			os.Remove(tmp)
+		}
+	}()
 
+	contents := make(map[string][]byte)
 	for _, file := range fileName {
-		cFile := certFile{FileName: file}
-		fmt.Println("searching for", downloadURL, filePath, file)
-
-		dest := path.Join(filePath, file)
-
-		jsonStr, err := json.Marshal(cFile)
+		body, err := fetchWithRetry(ctx, client, downloadURL, file, opts)
 		if err != nil {
-			fmt.Println("Error marshalling json: ", err)
+			return err
+		}
+		if err := checkPEM(file, body); err != nil {
+			return err
 		}
+		contents[file] = body
 
-		req, err := http.NewRequest("POST", downloadURL, bytes.NewBuffer(jsonStr))
+		tmp, err := writeTemp(filePath, body)
 		if err != nil {
-			fmt.Printf("Error making request: %v \n", err)
+			return err
 		}
+		temps = append(temps, tmp)
+	}
 
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Accept", "application/json")
+	if err := checkKeyPair(contents); err != nil {
+		return err
+	}
 
-		client := &http.Client{Transport: tr}
+	if err := install(filePath, fileName, temps, contents); err != nil {
+		return err
+	}
+	temps = nil
+	return nil
+}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			fmt.Printf("Error making API request: %v \n", err)
+// install renames each temporary file over its file in dir, private keys
+// first. If a rename fails, the files already replaced are put back, so a
+// certificate is never left next to a key it doesn't belong with.
+func install(dir string, fileName, temps []string, contents map[string][]byte) error {
+	order := make([]int, 0, len(fileName))
+	for i, file := range fileName {
+		if isKey(contents[file]) {
+			order = append(order, i)
 		}
-		defer resp.Body.Close()
+	}
+	for i, file := range fileName {
+		if !isKey(contents[file]) {
+			order = append(order, i)
+		}
+	}
 
-		fmt.Println(resp.Status, resp.StatusCode)
+	type replaced struct {
+		target, backup string
+	}
+	var done []replaced
+	rollback := func() {
+		for j := len(done) - 1; j >= 0; j-- {
+			if done[j].backup != "" {
+				os.Rename(done[j].backup, done[j].target)
+			} else {
+				os.Remove(done[j].target)
+			}
+		}
+	}
 
-		err = os.MkdirAll(filePath, os.ModePerm)
-		if err != nil {
+	for _, i := range order {
+		target := filepath.Join(dir, fileName[i])
+		r := replaced{target: target}
+		if _, err := os.Stat(target); err == nil {
+			r.backup = target + ".old"
+			if err := os.Rename(target, r.backup); err != nil {
+				rollback()
+				return err
+			}
+		}
+		if err := os.Rename(temps[i], target); err != nil {
+			if r.backup != "" {
+				os.Rename(r.backup, target)
+			}
+			rollback()
 			return err
 		}
+		done = append(done, r)
+	}
 
-		out, err := os.Create(dest)
-		if err != nil {
-			return err
+	for _, r := range done {
+		if r.backup != "" {
+			os.Remove(r.backup)
 		}
-		defer out.Close()
+	}
+	return nil
+}
 
-		_, err = io.Copy(out, resp.Body)
-		if err != nil {
-			return err
+func isKey(body []byte) bool {
+	for rest := body; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return false
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return true
+		}
+	}
+}
+
+func newClient(opts Options) (*http.Client, error) {
+	rootCAs, _ := x509.SystemCertPool()
+	if rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	if opts.CABundle != "" {
+		certs, err := ioutil.ReadFile(opts.CABundle)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, fmt.Errorf("reading CA bundle: %v", err)
+		case !rootCAs.AppendCertsFromPEM(certs):
+			return nil, fmt.Errorf("no certificates found in %s", opts.CABundle)
+		}
+	}
+
+	return &http.Client{
+		Timeout: opts.Timeout,
+		Transport: tracing.Transport(&http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: opts.Insecure, RootCAs: rootCAs},
+		}),
+	}, nil
+}
+
+func fetchWithRetry(ctx context.Context, client *http.Client, downloadURL, file string, opts Options) ([]byte, error) {
+	backoff := opts.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var body []byte
+		body, err = fetch(ctx, client, downloadURL, file)
+		if err == nil {
+			return body, nil
+		}
+		if serr, ok := err.(*StatusError); ok && !serr.temporary() {
+			return nil, err
+		}
+		if attempt >= opts.Attempts {
+			return nil, err
+		}
+
+		logging.Logger.Warn("downloading, will retry", "file", file, "backoff", backoff.String(), "err", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func fetch(ctx context.Context, client *http.Client, downloadURL, file string) ([]byte, error) {
+	jsonStr, err := json.Marshal(certFile{FileName: file})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", downloadURL, bytes.NewBuffer(jsonStr))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{File: file, Status: resp.Status, Code: resp.StatusCode}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxFileSize {
+		return nil, fmt.Errorf("downloading %s: file is larger than %d bytes", file, maxFileSize)
+	}
+	return body, nil
+}
+
+func writeTemp(dir string, body []byte) (string, error) {
+	tmp, err := ioutil.TempFile(dir, ".download-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// checkPEM makes sure body holds at least one PEM block.
+func checkPEM(file string, body []byte) error {
+	if block, _ := pem.Decode(body); block == nil {
+		return fmt.Errorf("downloading %s: response is not PEM", file)
+	}
+	return nil
+}
+
+// checkKeyPair finds the certificate and private key among the downloaded
+// files and makes sure they match.
+func checkKeyPair(contents map[string][]byte) error {
+	var certPEM, keyPEM []byte
+	for _, body := range contents {
+		for rest := body; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			switch {
+			case block.Type == "CERTIFICATE" && certPEM == nil:
+				certPEM = body
+			case (block.Type == "PRIVATE KEY" || block.Type == "RSA PRIVATE KEY" || block.Type == "EC PRIVATE KEY") && keyPEM == nil:
+				keyPEM = body
+			}
 		}
 	}
+
+	if certPEM == nil || keyPEM == nil {
+		return nil
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return fmt.Errorf("downloaded certificate and key don't match: %v", err)
+	}
 	return nil
 }
@@ -0,0 +1,118 @@
+// Package health tracks whether this instance should be sent traffic.
+package health
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNotServing = errors.New("not serving, starting up or shutting down")
+
+// CheckTimeout bounds each readiness check.
+var CheckTimeout = 2 * time.Second
+
+var (
+	ready int32
+
+	mu     sync.Mutex
+	checks = make(map[string]func(ctx context.Context) error)
+)
+
+// SetReady marks the instance as able, or no longer able, to take new
+// requests. It starts out not ready.
+func SetReady(r bool) {
+	var v int32
+	if r {
+		v = 1
+	}
+	atomic.StoreInt32(&ready, v)
+}
+
+// Ready reports whether SetReady(true) was the last call.
+func Ready() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// Register adds a readiness check, replacing any other of the same name.
+// check should return promptly once ctx is done.
+func Register(name string, check func(ctx context.Context) error) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks[name] = check
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Name       string  `json:"name"`
+	OK         bool    `json:"ok"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Report is the outcome of every check.
+type Report struct {
+	OK     bool     `json:"ok"`
+	Checks []Result `json:"checks"`
+}
+
+// Check runs every registered check at once, along with one that fails
+// while the instance isn't marked ready.
+func Check(ctx context.Context) Report {
+	mu.Lock()
+	run := make(map[string]func(ctx context.Context) error, len(checks)+1)
+	for name, check := range checks {
+		run[name] = check
+	}
+	mu.Unlock()
+	run["serving"] = func(context.Context) error {
+		if !Ready() {
+			return errNotServing
+		}
+		return nil
+	}
+
+	results := make(chan Result, len(run))
+	for name, check := range run {
+		go func(name string, check func(ctx context.Context) error) {
+			results <- runCheck(ctx, name, check)
+		}(name, check)
+	}
+
+	report := Report{OK: true}
+	for range run {
+		result := <-results
+		report.OK = report.OK && result.OK
+		report.Checks = append(report.Checks, result)
+	}
+	sort.Slice(report.Checks, func(i, j int) bool { return report.Checks[i].Name < report.Checks[j].Name })
+	return report
+}
+
+// runCheck times check, giving up on it after CheckTimeout.
+func runCheck(ctx context.Context, name string, check func(ctx context.Context) error) Result {
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := Result{Name: name, OK: err == nil, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,62 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter allows at most Max events per key within a sliding Window.
+// Keys are usually client IP addresses.
+type Limiter struct {
+	Max    int
+	Window time.Duration
+
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	lastSweep time.Time
+}
+
+func New(max int, window time.Duration) *Limiter {
+	return &Limiter{Max: max, Window: window, hits: make(map[string][]time.Time)}
+}
+
+// Allow records an event for key and reports whether it is within the limit.
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > l.Window {
+		l.sweep(now)
+	}
+
+	recent := prune(l.hits[key], now.Add(-l.Window))
+	if len(recent) >= l.Max {
+		l.hits[key] = recent
+		return false
+	}
+	l.hits[key] = append(recent, now)
+	return true
+}
+
+// sweep drops keys that have no events left inside the window so the map
+// doesn't grow with every address that has ever hit us.
+func (l *Limiter) sweep(now time.Time) {
+	cutoff := now.Add(-l.Window)
+	for key, times := range l.hits {
+		if recent := prune(times, cutoff); len(recent) > 0 {
+			l.hits[key] = recent
+		} else {
+			delete(l.hits, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func prune(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && !times[i].After(cutoff) {
+		i++
+	}
+	return times[i:]
+}
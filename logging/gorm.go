@@ -0,0 +1,29 @@
+package logging
+
+import (
+	"fmt"
+	"time"
+)
+
+// Gorm passes gorm's log lines to Logger. Queries are logged at debug
+// level without their values, which can hold passwords and message bodies.
+type Gorm struct{}
+
+func (Gorm) Print(v ...interface{}) {
+	if len(v) < 2 {
+		return
+	}
+
+	switch v[0] {
+	case "sql":
+		if len(v) < 4 {
+			return
+		}
+		duration, _ := v[2].(time.Duration)
+		Logger.Debug("sql", "source", v[1], "query", v[3], "duration_ms", float64(duration.Microseconds())/1000)
+	case "info":
+		Logger.Debug("gorm", "msg", fmt.Sprint(v[1:]...))
+	default:
+		Logger.Error("gorm", "source", v[1], "err", fmt.Sprint(v[2:]...))
+	}
+}
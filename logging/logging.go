@@ -0,0 +1,170 @@
+// Package logging writes leveled JSON logs to stdout, tagging everything
+// logged while handling a request with that request's ID.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Level is the lowest level logged, set from LOG_LEVEL: debug, info
+	// (the default), warn or error.
+	Level = new(slog.LevelVar)
+	// Logger is the logger for anything not tied to a request.
+	Logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       Level,
+		ReplaceAttr: redact,
+	}))
+)
+
+// sensitive are substrings of attribute keys whose values are never
+// logged.
+var sensitive = []string{"password", "passwd", "secret", "token", "authorization", "cookie", "session", "credential", "private_key"}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitive {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact blanks the value of any attribute whose key looks sensitive.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if isSensitive(a.Key) {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	return a
+}
+
+// requestPath is the path of the request handled by c, less any sensitive
+// route parameters such as share link tokens. The query string is left out
+// entirely, as it can carry OAuth codes.
+func requestPath(c echo.Context) string {
+	path := c.Request().URL.Path
+	values := c.ParamValues()
+	for i, name := range c.ParamNames() {
+		if i < len(values) && values[i] != "" && isSensitive(name) {
+			path = strings.Replace(path, values[i], "[REDACTED]", 1)
+		}
+	}
+	return path
+}
+
+type contextKey struct{}
+
+// RequestIDHeader carries the request ID in from a proxy, if it set one,
+// and back out in the response.
+const RequestIDHeader = "X-Request-Id"
+
+// Middleware gives each request an ID and a logger carrying it, and logs
+// the request once it's been handled.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+
+			id := req.Header.Get(RequestIDHeader)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			c.Response().Header().Set(RequestIDHeader, id)
+
+			logger := Logger.With("request_id", id)
+			if span := trace.SpanContextFromContext(req.Context()); span.IsValid() {
+				logger = logger.With("trace_id", span.TraceID().String())
+			}
+			c.Set("logger", logger)
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), contextKey{}, logger)))
+
+			err := next(c)
+			if err != nil && !c.Response().Committed {
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			level := slog.LevelInfo
+			if status >= 500 {
+				level = slog.LevelError
+			}
+			attrs := []any{
+				"method", req.Method,
+				"path", requestPath(c),
+				"route", c.Path(),
+				"status", status,
+				"bytes", c.Response().Size,
+				"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+				"ip", c.RealIP(),
+				"user_agent", req.UserAgent(),
+			}
+			if err != nil {
+				attrs = append(attrs, "err", err)
+			}
+			logger.Log(req.Context(), level, "request", attrs...)
+			return err
+		}
+	}
+}
+
+// From returns the logger for the request being handled by c.
+func From(c echo.Context) *slog.Logger {
+	if logger, ok := c.Get("logger").(*slog.Logger); ok {
+		return logger
+	}
+	return Logger
+}
+
+// FromContext returns the logger for the request ctx belongs to, or Logger
+// if it doesn't belong to one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return Logger
+}
+
+// validRequestID accepts IDs short enough and plain enough to be safe to
+// copy into logs and headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func init() {
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		Level.Set(slog.LevelDebug)
+	case "warn", "warning":
+		Level.Set(slog.LevelWarn)
+	case "error":
+		Level.Set(slog.LevelError)
+	}
+	// Anything still using the log package, like net/http's server
+	// errors, ends up in the same JSON stream.
+	slog.SetDefault(Logger)
+}
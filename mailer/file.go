@@ -0,0 +1,67 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File appends messages to an mbox file instead of sending them, so email
+// can be exercised offline. Point a mail client at the file to read them.
+type File struct {
+	Path    string
+	Charset string
+
+	mu sync.Mutex
+}
+
+func (f *File) Send(msg *Message) error {
+	path := f.Path
+	if path == "" {
+		path = "mail.mbox"
+	}
+
+	data, err := compose(msg, f.Charset)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", envelopeSender(msg.From), time.Now().Format(time.ANSIC))
+
+	// The whole message is in memory, so split it rather than scan it;
+	// bufio.Scanner gives up on lines over 64 KB, which an 8bit body can
+	// have.
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		// mboxrd quoting, so body lines can't be mistaken for a new message.
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+		buf.WriteString(line + "\n")
+	}
+	buf.WriteString("\n")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(buf.Bytes()); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func envelopeSender(from string) string {
+	if from = address(from); from == "" {
+		return "MAILER-DAEMON"
+	}
+	return from
+}
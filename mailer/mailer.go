@@ -0,0 +1,194 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/logging"
+)
+
+// Message is a plain text email.
+type Message struct {
+	From    string
+	To      []string
+	ReplyTo string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email. Implementations are safe for concurrent use.
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// Config selects and configures a Mailer. Type is one of "ses", "smtp" or
+// "file".
+type Config struct {
+	Type         string
+	Charset      string
+	SESRegion    string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUser     string
+	SMTPPassword string
+	SMTPStartTLS bool
+	FilePath     string
+}
+
+var (
+	// Default is the mailer configured from the app secrets, overridable with
+	// the MAILER and MAIL_FILE environment variables for local development.
+	Default Mailer
+
+	ErrHeader = errors.New("header contains a line break")
+)
+
+// Check rejects messages whose headers could be used to inject more
+// headers, and addresses that don't parse.
+func Check(msg *Message) error {
+	for _, v := range append([]string{msg.From, msg.ReplyTo, msg.Subject}, msg.To...) {
+		if strings.ContainsAny(v, "\r\n") {
+			return ErrHeader
+		}
+	}
+	if _, err := mail.ParseAddress(msg.From); err != nil {
+		return fmt.Errorf("from address: %v", err)
+	}
+	for _, to := range msg.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("to address: %v", err)
+		}
+	}
+	if msg.ReplyTo != "" {
+		if _, err := mail.ParseAddress(msg.ReplyTo); err != nil {
+			return fmt.Errorf("reply-to address: %v", err)
+		}
+	}
+	return nil
+}
+
+// unconfigured stands in for Default when the mailer config is broken, so
+// every send fails loudly instead of vanishing.
+type unconfigured struct {
+	err error
+}
+
+func (u unconfigured) Send(msg *Message) error {
+	logging.Logger.Error("sending email with unconfigured mailer", "err", u.err)
+	return fmt.Errorf("mailer not configured: %v", u.err)
+}
+
+// New returns the Mailer described by cfg.
+func New(cfg Config) (Mailer, error) {
+	if cfg.Charset == "" {
+		cfg.Charset = "UTF-8"
+	}
+
+	switch cfg.Type {
+	case "", "ses":
+		return NewSES(cfg.SESRegion, cfg.Charset)
+	case "smtp":
+		return &SMTP{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUser,
+			Password: cfg.SMTPPassword,
+			StartTLS: cfg.SMTPStartTLS,
+			Charset:  cfg.Charset,
+		}, nil
+	case "file":
+		return &File{Path: cfg.FilePath, Charset: cfg.Charset}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer type %q", cfg.Type)
+}
+
+// compose renders msg as an RFC 5322 message for the SMTP and file mailers.
+func compose(msg *Message, charset string) ([]byte, error) {
+	if err := Check(msg); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: %s\r\n", formatAddress(msg.From))
+	to := make([]string, len(msg.To))
+	for i, addr := range msg.To {
+		to[i] = formatAddress(addr)
+	}
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	if msg.ReplyTo != "" {
+		fmt.Fprintf(&buf, "Reply-To: %s\r\n", formatAddress(msg.ReplyTo))
+	}
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode(charset, msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", messageID(msg.From))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=%s\r\n", charset)
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(strings.Replace(strings.Replace(msg.Body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	buf.WriteString("\r\n")
+
+	return buf.Bytes(), nil
+}
+
+// formatAddress re-encodes an address Check has already parsed, quoting
+// and encoding the display name as needed.
+func formatAddress(addr string) string {
+	parsed, _ := mail.ParseAddress(addr)
+	return parsed.String()
+}
+
+// address strips any display name from addr, leaving the bare address
+// needed for the SMTP envelope.
+func address(addr string) string {
+	if parsed, err := mail.ParseAddress(addr); err == nil {
+		return parsed.Address
+	}
+	return strings.TrimSpace(addr)
+}
+
+func messageID(from string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(address(from), "@"); i >= 0 {
+		domain = address(from)[i+1:]
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+func init() {
+	cfg := datastores.MailerConfig
+	if t := os.Getenv("MAILER"); t != "" {
+		cfg.Type = t
+	}
+	if path := os.Getenv("MAIL_FILE"); path != "" {
+		cfg.FilePath = path
+	}
+
+	m, err := New(Config{
+		Type:         cfg.Type,
+		Charset:      datastores.CharSet,
+		SESRegion:    cfg.SESRegion,
+		SMTPHost:     cfg.SMTPHost,
+		SMTPPort:     cfg.SMTPPort,
+		SMTPUser:     cfg.SMTPUser,
+		SMTPPassword: cfg.SMTPPassword,
+		SMTPStartTLS: cfg.SMTPStartTLS,
+		FilePath:     cfg.FilePath,
+	})
+	if err != nil {
+		logging.Logger.Error("configuring mailer", "err", err)
+		m = unconfigured{err}
+	}
+	Default = m
+}
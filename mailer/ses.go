@@ -0,0 +1,68 @@
+package mailer
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+// SES sends mail through Amazon SES.
+type SES struct {
+	Charset string
+	svc     *ses.SES
+}
+
+// NewSES creates an SES mailer for region, defaulting to us-west-2.
+func NewSES(region, charset string) (*SES, error) {
+	if region == "" {
+		region = "us-west-2"
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating AWS session: %v", err)
+	}
+	return &SES{Charset: charset, svc: ses.New(sess)}, nil
+}
+
+func (s *SES) Send(msg *Message) error {
+	if err := Check(msg); err != nil {
+		return err
+	}
+
+	input := &ses.SendEmailInput{
+		Destination: &ses.Destination{
+			CcAddresses: []*string{},
+			ToAddresses: aws.StringSlice(msg.To),
+		},
+		Message: &ses.Message{
+			Body: &ses.Body{
+				Text: &ses.Content{
+					Charset: aws.String(s.Charset),
+					Data:    aws.String(msg.Body),
+				},
+			},
+			Subject: &ses.Content{
+				Charset: aws.String(s.Charset),
+				Data:    aws.String(msg.Subject),
+			},
+		},
+		Source: aws.String(msg.From),
+	}
+	if msg.ReplyTo != "" {
+		input.ReplyToAddresses = []*string{aws.String(msg.ReplyTo)}
+	}
+
+	if _, err := s.svc.SendEmail(input); err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			return fmt.Errorf("ses: %s: %s", aerr.Code(), aerr.Message())
+		}
+		return fmt.Errorf("ses: %v", err)
+	}
+	return nil
+}
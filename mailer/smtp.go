@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTP sends mail through a plain SMTP relay, upgrading the connection with
+// STARTTLS when StartTLS is set. Credentials are only sent over TLS.
+type SMTP struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	StartTLS bool
+	Charset  string
+}
+
+func (s *SMTP) Send(msg *Message) error {
+	data, err := compose(msg, s.Charset)
+	if err != nil {
+		return err
+	}
+
+	port := s.Port
+	if port == "" {
+		port = "587"
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(s.Host, port), 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp: %v", err)
+	}
+	defer c.Close()
+
+	if s.StartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return fmt.Errorf("smtp starttls: %v", err)
+		}
+	}
+
+	if s.Username != "" {
+		// PlainAuth refuses to send credentials over an unencrypted
+		// connection to anything but localhost.
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return fmt.Errorf("smtp auth: %v", err)
+		}
+	}
+
+	if err := c.Mail(address(msg.From)); err != nil {
+		return fmt.Errorf("smtp mail from: %v", err)
+	}
+	for _, to := range msg.To {
+		if err := c.Rcpt(address(to)); err != nil {
+			return fmt.Errorf("smtp rcpt to %s: %v", to, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp data: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return fmt.Errorf("smtp data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp data: %v", err)
+	}
+	return c.Quit()
+}
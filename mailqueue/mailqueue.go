@@ -0,0 +1,195 @@
+package mailqueue
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/mailer"
+	"github.com/dedgarsites/dedgar/metrics"
+	"github.com/dedgarsites/dedgar/models"
+	"github.com/dedgarsites/dedgar/tracing"
+)
+
+var (
+	// MaxAttempts is how many deliveries are tried before a message is
+	// marked dead.
+	MaxAttempts = 8
+	// PollInterval is how often the worker looks for due messages.
+	PollInterval = 10 * time.Second
+
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 6 * time.Hour
+	// staleAfter is how long a message may sit in sending before we assume
+	// the pod delivering it died and try again.
+	staleAfter = 10 * time.Minute
+	batchSize  = 20
+)
+
+// Enqueue stores msg for delivery by the worker.
+func Enqueue(msg *mailer.Message) error {
+	return EnqueueContext(context.Background(), msg)
+}
+
+// EnqueueContext is Enqueue, traced as part of the span in ctx.
+func EnqueueContext(ctx context.Context, msg *mailer.Message) error {
+	if err := mailer.Check(msg); err != nil {
+		return err
+	}
+
+	email := models.OutboundEmail{
+		From:          msg.From,
+		ReplyTo:       msg.ReplyTo,
+		Subject:       msg.Subject,
+		Body:          msg.Body,
+		Status:        models.EmailPending,
+		NextAttemptAt: time.Now(),
+	}
+	email.SetRecipients(msg.To)
+	return tracing.DB(ctx, datastores.DB).Create(&email).Error
+}
+
+// Run delivers due messages every PollInterval until ctx is cancelled.
+func Run(ctx context.Context) {
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	for {
+		DeliverDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue attempts every message whose next attempt is due and returns
+// how many were sent.
+func DeliverDue() int {
+	now := time.Now()
+
+	datastores.DB.Model(&models.OutboundEmail{}).
+		Where("status = ? AND updated_at < ?", models.EmailSending, now.Add(-staleAfter)).
+		Update("status", models.EmailPending)
+
+	var due []models.OutboundEmail
+	datastores.DB.Where("status = ? AND next_attempt_at <= ?", models.EmailPending, now).
+		Order("next_attempt_at asc").Limit(batchSize).Find(&due)
+
+	sent := 0
+	for i := range due {
+		if claim(&due[i]) && deliver(&due[i]) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// claim marks email as sending, failing if another worker got there first.
+func claim(email *models.OutboundEmail) bool {
+	res := datastores.DB.Model(&models.OutboundEmail{}).
+		Where("id = ? AND status = ?", email.ID, models.EmailPending).
+		Update("status", models.EmailSending)
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+// deliver sends email, tracing the attempt as a trace of its own since it
+// happens long after the request that queued it.
+func deliver(email *models.OutboundEmail) bool {
+	ctx, span := tracing.Tracer.Start(context.Background(), "mailqueue.deliver",
+		trace.WithAttributes(
+			attribute.Int64("email.id", int64(email.ID)),
+			attribute.Int("email.attempt", email.Attempts+1),
+		))
+	defer span.End()
+	db := tracing.DB(ctx, datastores.DB)
+
+	msg := &mailer.Message{
+		From:    email.From,
+		To:      email.Recipients(),
+		ReplyTo: email.ReplyTo,
+		Subject: email.Subject,
+		Body:    email.Body,
+	}
+
+	attempts := email.Attempts + 1
+	_, send := tracing.Tracer.Start(ctx, "mailer.Send", trace.WithSpanKind(trace.SpanKindClient))
+	err := mailer.Default.Send(msg)
+	tracing.End(send, err)
+	if err == nil {
+		metrics.Emails.WithLabelValues("sent").Inc()
+		now := time.Now()
+		db.Model(email).Updates(map[string]interface{}{
+			"status":   models.EmailSent,
+			"attempts": attempts,
+			"sent_at":  &now,
+		})
+		return true
+	}
+
+	updates := map[string]interface{}{
+		"status":     models.EmailPending,
+		"attempts":   attempts,
+		"last_error": err.Error(),
+	}
+	if attempts >= MaxAttempts {
+		updates["status"] = models.EmailDead
+		metrics.Emails.WithLabelValues("dead").Inc()
+		logging.Logger.Error("giving up on email", "id", email.ID, "to", email.Recipients(), "attempts", attempts, "err", err)
+	} else {
+		updates["next_attempt_at"] = time.Now().Add(backoff(attempts))
+		metrics.Emails.WithLabelValues("retry").Inc()
+		logging.Logger.Warn("email failed", "id", email.ID, "to", email.Recipients(), "attempts", attempts, "err", err)
+	}
+	span.SetStatus(codes.Error, err.Error())
+	db.Model(email).Updates(updates)
+	return false
+}
+
+// backoff doubles the wait after every failed attempt, with up to 20%
+// jitter so a batch of failures doesn't retry in lockstep.
+func backoff(attempts int) time.Duration {
+	wait := baseBackoff << uint(attempts-1)
+	if wait > maxBackoff || wait <= 0 {
+		wait = maxBackoff
+	}
+	return wait + time.Duration(rand.Int63n(int64(wait)/5+1))
+}
+
+// Retry puts a dead message back in the queue with a fresh set of attempts.
+func Retry(id uint) error {
+	return datastores.DB.Model(&models.OutboundEmail{}).
+		Where("id = ? AND status = ?", id, models.EmailDead).
+		Updates(map[string]interface{}{
+			"status":          models.EmailPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now(),
+		}).Error
+}
+
+// Outstanding returns messages that have not been delivered, with dead
+// ones last.
+func Outstanding() []models.OutboundEmail {
+	var emails []models.OutboundEmail
+	datastores.DB.Where("status IN (?)", []string{models.EmailPending, models.EmailSending, models.EmailDead}).
+		Order("status desc, next_attempt_at asc").Find(&emails)
+	return emails
+}
+
+// Flush delivers due messages until none are left or ctx is done, for a
+// last pass before shutting down. Anything undelivered stays queued for
+// the next instance.
+func Flush(ctx context.Context) {
+	for ctx.Err() == nil {
+		if DeliverDue() == 0 {
+			return
+		}
+	}
+}
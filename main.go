@@ -2,12 +2,26 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"golang.org/x/crypto/acme"
+
+	"github.com/dedgarsites/dedgar/certstore"
+	"github.com/dedgarsites/dedgar/controllers"
+	"github.com/dedgarsites/dedgar/datastores"
 	"github.com/dedgarsites/dedgar/downloader"
+	"github.com/dedgarsites/dedgar/health"
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/mailer"
+	"github.com/dedgarsites/dedgar/mailqueue"
 	"github.com/dedgarsites/dedgar/routers"
+	"github.com/dedgarsites/dedgar/tracing"
+	"github.com/dedgarsites/dedgar/tree"
 )
 
 var (
@@ -15,31 +29,180 @@ var (
 	keyFile     = os.Getenv("KEY_FILE")
 	downloadURL = os.Getenv("DOWNLOAD_URL")
 	filePath    = os.Getenv("TLS_FILE_PATH")
+	// tlsSource picks where certificates come from: "download" (the
+	// default) fetches them from DOWNLOAD_URL, "acme" requests them from
+	// an ACME CA.
+	tlsSource = os.Getenv("TLS_SOURCE")
+	// certAlertEmail, if set, is sent a warning as the certificate nears
+	// expiry, in addition to the warnings logged at CERT_WARN_DAYS.
+	certAlertEmail = os.Getenv("CERT_ALERT_EMAIL")
 )
 
 func main() {
 	e := routers.Routers
 
+	stopTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		logging.Logger.Error("setting up tracing", "err", err)
+		stopTracing = func(context.Context) error { return nil }
+	}
+
+	bg := newWorkers()
+	bg.Go(mailqueue.Run)
+	bg.Go(func(ctx context.Context) {
+		datastores.Connect(ctx, func() {
+			datastores.CheckDB()
+			controllers.TrainContactFilter()
+		})
+	})
+	bg.Go(func(ctx context.Context) {
+		tree.Watch(ctx, tree.RefreshInterval)
+	})
+
 	if localPort := os.Getenv("LOCAL_TESTING"); localPort != "" {
-		e.Logger.Info(e.Start(":" + localPort))
+		e.Server.Addr = ":" + localPort
+		serveUntilSignalled(e, e.Server, nil, bg, stopTracing)
+		return
+	}
+
+	var tlsConfig *tls.Config
+	redirect := redirectHTTPS()
+	if tlsSource == "acme" {
+		var challenges func(http.Handler) http.Handler
+		if tlsConfig, challenges, err = acmeTLS(); err != nil {
+			logging.Logger.Error("setting up ACME", "err", err)
+			os.Exit(1)
+		}
+		redirect = challenges(redirect)
 	} else {
-		err := downloader.FileFromURL(downloadURL, filePath, certFile, keyFile)
-		if err != nil {
-			fmt.Println(err)
+		tlsConfig = downloadedTLS(bg)
+	}
+	httpServer := serveHTTP(redirect, tlsSource == "acme")
+
+	monitorCerts(bg)
+	health.Register("certificates", func(ctx context.Context) error {
+		if status := certstore.DefaultMonitor.Status(); !status.Loaded || status.Expired {
+			return certstore.ErrNoCertificate
 		}
+		return nil
+	})
+
+	e.TLSServer.Addr = ":8443"
+	if err := configureTLS(e.TLSServer, tlsConfig); err != nil {
+		logging.Logger.Error("configuring TLS", "err", err)
+		os.Exit(1)
+	}
+	serveUntilSignalled(e, e.TLSServer, httpServer, bg, stopTracing)
+}
+
+// downloadedTLS serves the keypair from DOWNLOAD_URL, fetching it again
+// every CERT_REFRESH in bg.
+func downloadedTLS(bg *workers) *tls.Config {
+	certs := certstore.New(filePath+certFile, filePath+keyFile)
+	opts := downloader.DefaultOptions
+	opts.Insecure = os.Getenv("INSECURE_SSL") == "true"
+	certs.Fetch = func() error {
+		return downloader.FileFromURLContext(bg.ctx, downloadURL, filePath, opts, certFile, keyFile)
+	}
+	if interval, err := time.ParseDuration(os.Getenv("CERT_REFRESH")); err == nil && interval > 0 {
+		certs.FetchInterval = interval
+	}
+
+	// A failed download isn't fatal if there's a usable keypair left on
+	// disk from before.
+	if err := certs.Refresh(); err != nil {
+		logging.Logger.Error("refreshing certificate", "err", err)
+		if err := certs.Load(); err != nil {
+			logging.Logger.Error("loading certificate", "err", err)
+		}
+	}
+	bg.Go(certs.Run)
 
-		go func() {
-			time.Sleep(24 * 60 * time.Hour)
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			defer cancel()
-			if err := e.Shutdown(ctx); err != nil {
-				e.Logger.Info(err)
+	certstore.DefaultMonitor.Current = certs.Certificate
+	return &tls.Config{GetCertificate: certs.GetCertificate}
+}
+
+// acmeTLS serves certificates issued for ACME_DOMAINS by the CA at
+// ACME_DIRECTORY. TLS-ALPN-01 challenges are answered on the TLS port, and
+// HTTP-01 challenges by the handler wrapped with the returned function,
+// which passes anything else through.
+func acmeTLS() (*tls.Config, func(http.Handler) http.Handler, error) {
+	cfg := certstore.ACMEConfig{
+		Email:        os.Getenv("ACME_EMAIL"),
+		DirectoryURL: os.Getenv("ACME_DIRECTORY"),
+		CacheDir:     os.Getenv("ACME_CACHE_DIR"),
+		CABundle:     os.Getenv("ACME_CA_BUNDLE"),
+	}
+	for _, domain := range strings.Split(os.Getenv("ACME_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			cfg.Domains = append(cfg.Domains, domain)
+		}
+	}
+	if cfg.CacheDir == "" {
+		cfg.CacheDir = filepath.Join(filePath, "acme")
+	}
+	if renew, err := time.ParseDuration(os.Getenv("ACME_RENEW_BEFORE")); err == nil && renew > 0 {
+		cfg.RenewBefore = renew
+	}
+
+	m, err := certstore.NewACME(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(cfg.Domains) > 0 {
+		// autocert hands out an RSA certificate to clients it doesn't
+		// think support ECDSA, and issues one if there isn't one yet, so
+		// ask the way a modern browser would to get the certificate
+		// browsers are served.
+		hello := &tls.ClientHelloInfo{
+			ServerName:       cfg.Domains[0],
+			SupportedCurves:  []tls.CurveID{tls.X25519, tls.CurveP256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384, tls.PSSWithSHA256},
+			CipherSuites: []uint16{
+				tls.TLS_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			},
+			SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+		}
+		certstore.DefaultMonitor.Current = func() *tls.Certificate {
+			cert, err := m.GetCertificate(hello)
+			if err != nil {
+				return nil
 			}
-		}()
+			return cert
+		}
+	}
 
-		if _, err := os.Stat(filePath + certFile); os.IsNotExist(err) {
-			fmt.Println("Cert file does not exist:", err)
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	}, m.HTTPHandler, nil
+}
+
+// monitorCerts starts warning about the served certificate's expiry at the
+// thresholds in CERT_WARN_DAYS, emailing CERT_ALERT_EMAIL if it's set. The
+// monitor runs in bg.
+func monitorCerts(bg *workers) {
+	monitor := certstore.DefaultMonitor
+	if days := os.Getenv("CERT_WARN_DAYS"); days != "" {
+		thresholds, err := certstore.ParseThresholds(days)
+		if err != nil {
+			logging.Logger.Error("parsing CERT_WARN_DAYS", "err", err)
+		} else {
+			monitor.Thresholds = thresholds
+		}
+	}
+	if certAlertEmail != "" {
+		monitor.Notify = func(subject, body string) error {
+			return mailqueue.Enqueue(&mailer.Message{
+				From:    datastores.Sender,
+				To:      []string{certAlertEmail},
+				Subject: subject,
+				Body:    body,
+			})
 		}
-		e.Logger.Info(e.StartTLS(":8443", filePath+certFile, filePath+keyFile))
 	}
+	bg.Go(monitor.Run)
 }
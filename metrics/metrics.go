@@ -0,0 +1,171 @@
+// Package metrics collects Prometheus metrics for the site, served on
+// /metrics.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dedgarsites/dedgar/certstore"
+	"github.com/dedgarsites/dedgar/models"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// Requests counts HTTP requests by method, route and status.
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by method, route and status.",
+	}, []string{"method", "route", "status"})
+	// RequestDuration times HTTP requests by method and route.
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	// TemplateRender times html/template executions by template name.
+	TemplateRender = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "template_render_duration_seconds",
+		Help:    "Time taken to render templates, by template.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+	}, []string{"template"})
+	// DBQueries times database statements by operation.
+	DBQueries = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Time taken by database statements, by operation.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation"})
+	// Emails counts outbound email delivery attempts by outcome: sent,
+	// retry or dead.
+	Emails = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "email_deliveries_total",
+		Help: "Outbound email delivery attempts, by outcome.",
+	}, []string{"outcome"})
+	// Logins counts login attempts by method, google or password, and
+	// result, success or failure.
+	Logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logins_total",
+		Help: "Login attempts, by method and result.",
+	}, []string{"method", "result"})
+	// Takedowns counts takedowns created, by category name from
+	// models.TakedownCategory.
+	Takedowns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "takedowns_created_total",
+		Help: "Takedowns created, by category.",
+	}, []string{"category"})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
+
+// Middleware counts and times every request, by the route that matched
+// rather than the path so there's a bounded number of series.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil && !c.Response().Committed {
+				// Let the error handler write the response now so its
+				// status is what gets counted.
+				c.Error(err)
+			}
+
+			// Echo gives requests that matched no route their own path,
+			// which would let scanners add a series for every URL tried.
+			route := c.Path()
+			if route == "" || c.Response().Status == http.StatusNotFound && route == c.Request().URL.Path {
+				route = "unmatched"
+			}
+			method := c.Request().Method
+			RequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+			Requests.WithLabelValues(method, route, strconv.Itoa(c.Response().Status)).Inc()
+			// The response is already written, but the middleware
+			// outside still wants to know what went wrong.
+			return err
+		}
+	}
+}
+
+// Login records the result of a login attempt.
+func Login(method string, success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	Logins.WithLabelValues(method, result).Inc()
+}
+
+// TakedownCreated records a new takedown in category, one of the keys of
+// models.TakedownCategory.
+func TakedownCreated(category int) {
+	name, ok := models.TakedownCategory[category]
+	if !ok {
+		name = models.TakedownCategory[1]
+	}
+	Takedowns.WithLabelValues(name).Inc()
+}
+
+// InstrumentDB times every statement run through db.
+func InstrumentDB(db *gorm.DB) {
+	const startKey = "metrics:start"
+
+	before := func(scope *gorm.Scope) {
+		scope.Set(startKey, time.Now())
+	}
+	after := func(operation string) func(scope *gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			if start, ok := scope.Get(startKey); ok {
+				DBQueries.WithLabelValues(operation).Observe(time.Since(start.(time.Time)).Seconds())
+			}
+		}
+	}
+
+	callbacks := db.Callback()
+	callbacks.Create().Before("gorm:begin_transaction").Register("metrics:before_create", before)
+	callbacks.Create().After("gorm:commit_or_rollback_transaction").Register("metrics:after_create", after("create"))
+	callbacks.Query().Before("gorm:query").Register("metrics:before_query", before)
+	callbacks.Query().After("gorm:after_query").Register("metrics:after_query", after("query"))
+	callbacks.Update().Before("gorm:begin_transaction").Register("metrics:before_update", before)
+	callbacks.Update().After("gorm:commit_or_rollback_transaction").Register("metrics:after_update", after("update"))
+	callbacks.Delete().Before("gorm:begin_transaction").Register("metrics:before_delete", before)
+	callbacks.Delete().After("gorm:commit_or_rollback_transaction").Register("metrics:after_delete", after("delete"))
+	callbacks.RowQuery().Before("gorm:row_query").Register("metrics:before_row_query", before)
+	callbacks.RowQuery().After("gorm:row_query").Register("metrics:after_row_query", after("row_query"))
+}
+
+// certExpiry reports the days left on the served certificate, when there
+// is one.
+type certExpiry struct {
+	desc *prometheus.Desc
+}
+
+func (c certExpiry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c certExpiry) Collect(ch chan<- prometheus.Metric) {
+	if status := certstore.DefaultMonitor.Status(); status.Loaded {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, status.DaysLeft)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(certExpiry{prometheus.NewDesc(
+		"tls_cert_days_until_expiry",
+		"Days until the first certificate in the served chain expires.",
+		nil, nil,
+	)})
+
+	// Start every category at zero so rates work from the first takedown.
+	for _, name := range models.TakedownCategory {
+		Takedowns.WithLabelValues(name)
+	}
+}
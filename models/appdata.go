@@ -14,4 +14,18 @@ type AppSecrets struct {
 	Sender          string
 	Recipient       string
 	AuthMap         map[string]bool
+	Mailer          MailerSecrets
+}
+
+// MailerSecrets selects the outgoing mail transport. Type is "ses" (the
+// default), "smtp" or "file".
+type MailerSecrets struct {
+	Type         string
+	SESRegion    string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUser     string
+	SMTPPassword string
+	SMTPStartTLS bool
+	FilePath     string
 }
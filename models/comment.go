@@ -0,0 +1,26 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// Comment statuses. New comments wait in the moderation queue as pending
+// until an admin approves or rejects them.
+const (
+	CommentPending  = "pending"
+	CommentApproved = "approved"
+	CommentRejected = "rejected"
+	CommentSpam     = "spam"
+)
+
+type Comment struct {
+	gorm.Model
+	PostName string `gorm:"index"`
+	ParentID uint   `gorm:"index"`
+	Name     string
+	Email    string     `json:"-"`
+	Body     string     `gorm:"type:text"`
+	IP       string     `json:"-"`
+	Status   string     `gorm:"index"`
+	Replies  []*Comment `gorm:"-"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Contact message statuses, as shown in the admin inbox.
+const (
+	MessageNew      = "new"
+	MessageReplied  = "replied"
+	MessageSpam     = "spam"
+	MessageArchived = "archived"
+)
+
+// MessageStatuses lists the contact message statuses in inbox order.
+var MessageStatuses = []string{MessageNew, MessageReplied, MessageSpam, MessageArchived}
+
+// ContactMessage is a contact form submission. Submissions the spam filter
+// catches are stored with the spam status and Quarantined set until someone
+// reviews them; Score and Reasons record why they were caught.
+type ContactMessage struct {
+	gorm.Model
+	Name        string
+	Email       string `gorm:"index"`
+	Message     string `gorm:"type:text"`
+	IP          string
+	Status      string `gorm:"index"`
+	Reply       string `gorm:"type:text"`
+	RepliedAt   *time.Time
+	Quarantined bool `gorm:"index"`
+	Score       float64
+	Reasons     string `gorm:"type:text"`
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Outbound email statuses. Messages are pending until the queue worker
+// claims them as sending, and end up sent or, after running out of retries,
+// dead.
+const (
+	EmailPending = "pending"
+	EmailSending = "sending"
+	EmailSent    = "sent"
+	EmailDead    = "dead"
+)
+
+type OutboundEmail struct {
+	gorm.Model
+	From          string
+	To            string `gorm:"type:text"`
+	ReplyTo       string
+	Subject       string
+	Body          string `gorm:"type:text"`
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     string    `gorm:"type:text"`
+	SentAt        *time.Time
+}
+
+// SetRecipients stores to in e.To as JSON, since a display name can contain
+// a comma.
+func (e *OutboundEmail) SetRecipients(to []string) {
+	data, _ := json.Marshal(to) // a []string always marshals
+	e.To = string(data)
+}
+
+// Recipients returns the addresses stored by SetRecipients. Messages queued
+// before that have them comma separated instead.
+func (e OutboundEmail) Recipients() []string {
+	var to []string
+	if err := json.Unmarshal([]byte(e.To), &to); err != nil {
+		return strings.Split(e.To, ",")
+	}
+	return to
+}
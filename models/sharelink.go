@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ShareLink grants anyone holding its URL read-only access to one file or
+// folder of the tree. Path is the tree path, ending in "/" for folders.
+// PasswordHash is empty for links without a password, and MaxDownloads is
+// zero for links that can be downloaded any number of times.
+type ShareLink struct {
+	gorm.Model
+	Key          string `gorm:"unique_index"`
+	Path         string
+	PasswordHash string
+	ExpiresAt    time.Time `gorm:"index"`
+	MaxDownloads int
+	Downloads    int
+	CreatedBy    string
+	Revoked      bool
+}
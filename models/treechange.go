@@ -0,0 +1,25 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// Tree change actions.
+const (
+	TreeUpload = "upload"
+	TreeMkdir  = "mkdir"
+	TreeMove   = "move"
+	TreeDelete = "delete"
+)
+
+// TreeChange is the audit record of one edit to the file tree. Target is
+// the destination of a move and empty otherwise.
+type TreeChange struct {
+	gorm.Model
+	User   string `gorm:"index"`
+	Action string
+	Path   string
+	Target string
+	Size   int64
+	IP     string
+}
@@ -0,0 +1,50 @@
+package routers
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/labstack/echo"
+
+	"github.com/dedgarsites/dedgar/logging"
+)
+
+var (
+	// hstsMaxAge is how many seconds browsers should only use HTTPS for
+	// the site. HSTS is off unless it's set.
+	hstsMaxAge = os.Getenv("HSTS_MAX_AGE")
+	// hstsPreload asks for the site to be added to browsers' preload lists,
+	// which requires subdomains be included and a max-age of a year.
+	hstsPreload = os.Getenv("HSTS_PRELOAD") == "true"
+	// hstsSubdomains is false when HSTS_INCLUDE_SUBDOMAINS is "false".
+	hstsSubdomains = os.Getenv("HSTS_INCLUDE_SUBDOMAINS") != "false"
+)
+
+// hsts sets Strict-Transport-Security on responses served over HTTPS,
+// directly or through a proxy that terminated TLS.
+func hsts() echo.MiddlewareFunc {
+	maxAge, err := strconv.Atoi(hstsMaxAge)
+	if hstsMaxAge != "" && (err != nil || maxAge < 0) {
+		logging.Logger.Error("parsing HSTS_MAX_AGE", "value", hstsMaxAge)
+	}
+	if hstsPreload && (maxAge < 31536000 || !hstsSubdomains) {
+		logging.Logger.Warn("HSTS preload needs HSTS_MAX_AGE of at least 31536000 and subdomains included")
+	}
+
+	header := "max-age=" + strconv.Itoa(maxAge)
+	if hstsSubdomains {
+		header += "; includeSubDomains"
+	}
+	if hstsPreload {
+		header += "; preload"
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if maxAge > 0 && (c.IsTLS() || c.Request().Header.Get(echo.HeaderXForwardedProto) == "https") {
+				c.Response().Header().Set(echo.HeaderStrictTransportSecurity, header)
+			}
+			return next(c)
+		}
+	}
+}
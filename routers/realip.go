@@ -0,0 +1,80 @@
+package routers
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo"
+
+	"github.com/dedgarsites/dedgar/logging"
+)
+
+// trustedProxies lists the addresses or CIDR ranges, comma separated, of
+// proxies in front of the site, such as the OpenShift router. Forwarding
+// headers are ignored unless the connection comes from one of them.
+var trustedProxies = os.Getenv("TRUSTED_PROXIES")
+
+// realIP works out the client address from the connection and any
+// forwarding headers added by trusted proxies, then leaves only that address
+// in X-Real-IP so c.RealIP() can't be spoofed with X-Forwarded-For.
+func realIP() echo.MiddlewareFunc {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(trustedProxies, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			logging.Logger.Error("parsing TRUSTED_PROXIES", "value", entry, "err", err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ip, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				ip = req.RemoteAddr
+			}
+
+			// Each proxy appends the address it got the request from, so
+			// walk back from the end until reaching one we don't run.
+			if trusted(ip) {
+				hops := strings.Split(req.Header.Get(echo.HeaderXForwardedFor), ",")
+				for i := len(hops) - 1; i >= 0 && trusted(ip); i-- {
+					if hop := strings.TrimSpace(hops[i]); hop != "" {
+						ip = hop
+					}
+				}
+			}
+
+			req.Header.Del(echo.HeaderXForwardedFor)
+			req.Header.Set(echo.HeaderXRealIP, ip)
+			return next(c)
+		}
+	}
+}
@@ -7,16 +7,24 @@ import (
 
 	"github.com/gorilla/sessions"
 
+	"context"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/dedgarsites/dedgar/auth"
 	"github.com/dedgarsites/dedgar/controllers"
 	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/health"
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/metrics"
+	"github.com/dedgarsites/dedgar/tracing"
+	"github.com/dedgarsites/dedgar/tree"
 )
 
 var (
@@ -30,13 +38,56 @@ type Template struct {
 }
 
 func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	start := time.Now()
+	defer func() {
+		metrics.TemplateRender.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}()
 	return t.templates.ExecuteTemplate(w, name, data)
 }
 
+// registerChecks adds what the site needs to serve pages to the readiness
+// checks.
+func registerChecks(t *Template, templateErrors int) {
+	health.Register("templates", func(ctx context.Context) error {
+		if templateErrors > 0 {
+			return fmt.Errorf("%d templates failed to parse", templateErrors)
+		}
+		if t.templates.Lookup("main.html") == nil {
+			return errors.New("main.html not loaded")
+		}
+		return nil
+	})
+	health.Register("database", func(ctx context.Context) error {
+		if datastores.DB == nil || datastores.DB.DB() == nil {
+			return errors.New("not connected")
+		}
+		if err := datastores.DB.DB().PingContext(ctx); err != nil {
+			return err
+		}
+		if !datastores.Connected() {
+			return errors.New("schema not checked yet")
+		}
+		return nil
+	})
+	health.Register("tree", func(ctx context.Context) error {
+		if !tree.Loaded() {
+			return errors.New("file tree not listed yet")
+		}
+		return nil
+	})
+	health.Register("posts", func(ctx context.Context) error {
+		if len(datastores.PostMap) == 0 {
+			return errors.New("no posts indexed")
+		}
+		return nil
+	})
+}
+
 func init() {
 	if sitePath == "" {
 		sitePath = "."
 	}
+	templateErrors := 0
 	t := &Template{
 		templates: func() *template.Template {
 			tmpl := template.New("")
@@ -44,7 +95,8 @@ func init() {
 				if strings.HasSuffix(path, ".html") {
 					_, err = tmpl.ParseFiles(path)
 					if err != nil {
-						log.Println(err)
+						logging.Logger.Error("parsing template", "path", path, "err", err)
+						templateErrors++
 					}
 				}
 				return err
@@ -56,12 +108,23 @@ func init() {
 	}
 
 	Routers = echo.New()
+	Routers.HideBanner = true
+	// Everything under static is public, so the tree's files can't be, or
+	// they'd skip its login and share link checks.
+	if store, ok := tree.DefaultStore.(tree.LocalStore); ok && store.Overlaps(sitePath+"/static") {
+		logging.Logger.Error("TREE_ROOT overlaps the public static directory", "root", store.Root, "static", sitePath+"/static")
+		os.Exit(1)
+	}
 	Routers.Static("/", sitePath+"/static")
 	Routers.Renderer = t
 
-	Routers.Use(middleware.Logger())
+	Routers.Pre(realIP())
+	Routers.Use(tracing.Middleware())
+	Routers.Use(logging.Middleware())
+	Routers.Use(metrics.Middleware())
 	Routers.Use(middleware.Recover())
 	Routers.Use(middleware.CORS())
+	Routers.Use(hsts())
 	Routers.Use(session.Middleware(sessions.NewCookieStore([]byte(datastores.CookieSecret))))
 
 	//auth_group := Routers.Group("/graph")
@@ -76,18 +139,25 @@ func init() {
 	Routers.GET("/oauth/callback", auth.HandleGoogleCallback)
 
 	datastores.FindPosts(sitePath+"/tmpl/posts", ".html")
+	datastores.DB.SetLogger(logging.Gorm{})
+	metrics.InstrumentDB(datastores.DB)
+	tracing.InstrumentDB(datastores.DB)
+	registerChecks(t, templateErrors)
 
 	Routers.GET("/", controllers.GetMain)
 	Routers.POST("/", controllers.GetMain)
 	Routers.GET("/about", controllers.GetAbout)
-	Routers.GET("/all/*", controllers.GetTreeAll)
+	Routers.GET("/all/*", controllers.GetTreeAll, controllers.AuthMiddleware())
+	Routers.GET("/download/*", controllers.GetTreeFile, controllers.AuthMiddleware())
+	Routers.GET("/thumb/*", controllers.GetTreeThumb, controllers.AuthMiddleware())
+	Routers.GET("/api/tree/*", controllers.GetApiTree, controllers.AuthMiddleware())
 	Routers.GET("/about-us", controllers.GetAbout)
 	Routers.GET("/register", controllers.GetRegister)
 	Routers.POST("/register", auth.PostRegister)
 	Routers.GET("/login", controllers.GetLogin)
 	Routers.POST("/login", auth.PostLogin)
 	Routers.GET("/trial", controllers.GetTrial)
-	Routers.GET("/tree", controllers.GetTree)
+	Routers.GET("/tree", controllers.GetTree, controllers.AuthMiddleware())
 	Routers.GET("/graph", controllers.GetGraph)
 	Routers.GET("/api/graph", controllers.GetApiGraph)
 	Routers.GET("/contact", controllers.GetContact)
@@ -101,6 +171,49 @@ func init() {
 	Routers.GET("/posts/", controllers.GetPostView)
 	Routers.GET("/post/:postname", controllers.GetPost)
 	Routers.GET("/posts/:postname", controllers.GetPost)
+	Routers.POST("/post/:postname/comments", controllers.PostComment)
+	Routers.GET("/api/post/:postname/comments", controllers.GetApiComments)
+	Routers.POST("/api/post/:postname/comments", controllers.PostApiComment)
+	Routers.GET("/admin/comments", controllers.GetAdminComments, controllers.AuthMiddleware())
+	Routers.POST("/admin/comments/:id/approve", controllers.PostApproveComment, controllers.AuthMiddleware())
+	Routers.POST("/admin/comments/:id/reject", controllers.PostRejectComment, controllers.AuthMiddleware())
+	Routers.GET("/api/admin/comments", controllers.GetApiAdminComments, controllers.AuthMiddleware())
+	Routers.POST("/api/admin/comments/:id/approve", controllers.PostApproveComment, controllers.AuthMiddleware())
+	Routers.POST("/api/admin/comments/:id/reject", controllers.PostRejectComment, controllers.AuthMiddleware())
+	Routers.GET("/admin/quarantine", controllers.GetQuarantine, controllers.AuthMiddleware())
+	Routers.POST("/admin/quarantine/:id/release", controllers.PostReleaseQuarantine, controllers.AuthMiddleware())
+	Routers.POST("/admin/quarantine/:id/spam", controllers.PostConfirmSpam, controllers.AuthMiddleware())
+	Routers.GET("/admin/mail", controllers.GetMailQueue, controllers.AuthMiddleware())
+	Routers.POST("/admin/mail/:id/retry", controllers.PostRetryMail, controllers.AuthMiddleware())
+	Routers.GET("/admin/messages", controllers.GetInbox, controllers.AuthMiddleware())
+	Routers.GET("/admin/messages/:id", controllers.GetInboxMessage, controllers.AuthMiddleware())
+	Routers.POST("/admin/messages/:id/reply", controllers.PostInboxReply, controllers.AuthMiddleware())
+	Routers.POST("/admin/messages/:id/status", controllers.PostInboxStatus, controllers.AuthMiddleware())
+	Routers.POST("/admin/tree/upload", controllers.PostTreeUpload, controllers.AuthMiddleware())
+	Routers.POST("/admin/tree/mkdir", controllers.PostTreeMkdir, controllers.AuthMiddleware())
+	Routers.POST("/admin/tree/move", controllers.PostTreeMove, controllers.AuthMiddleware())
+	Routers.POST("/admin/tree/delete", controllers.PostTreeDelete, controllers.AuthMiddleware())
+	Routers.POST("/api/admin/tree/upload", controllers.PostTreeUpload, controllers.AuthMiddleware())
+	Routers.POST("/api/admin/tree/mkdir", controllers.PostTreeMkdir, controllers.AuthMiddleware())
+	Routers.POST("/api/admin/tree/move", controllers.PostTreeMove, controllers.AuthMiddleware())
+	Routers.POST("/api/admin/tree/delete", controllers.PostTreeDelete, controllers.AuthMiddleware())
+	Routers.POST("/api/admin/tree/uploads", controllers.PostTreeChunkedUpload, controllers.AuthMiddleware())
+	Routers.GET("/api/admin/tree/uploads/:id", controllers.GetTreeChunkedUpload, controllers.AuthMiddleware())
+	Routers.PUT("/api/admin/tree/uploads/:id", controllers.PutTreeChunk, controllers.AuthMiddleware())
+	Routers.DELETE("/api/admin/tree/uploads/:id", controllers.DeleteTreeChunkedUpload, controllers.AuthMiddleware())
+	Routers.GET("/s/:token", controllers.GetShareRoot)
+	Routers.POST("/s/:token", controllers.PostShareUnlock)
+	Routers.GET("/s/:token/*", controllers.GetShare)
+	Routers.GET("/admin/shares", controllers.GetAdminShares, controllers.AuthMiddleware())
+	Routers.POST("/admin/shares", controllers.PostShare, controllers.AuthMiddleware())
+	Routers.POST("/admin/shares/:id/revoke", controllers.PostRevokeShare, controllers.AuthMiddleware())
+	Routers.GET("/api/admin/shares", controllers.GetApiAdminShares, controllers.AuthMiddleware())
+	Routers.POST("/api/admin/shares", controllers.PostShare, controllers.AuthMiddleware())
+	Routers.POST("/api/admin/shares/:id/revoke", controllers.PostRevokeShare, controllers.AuthMiddleware())
+	Routers.GET("/healthz", controllers.GetHealthz)
+	Routers.GET("/readyz", controllers.GetReadyz)
+	Routers.GET("/healthz/tls", controllers.GetHealthTLS)
+	Routers.GET("/metrics", metrics.Handler())
 	Routers.File("/robots.txt", sitePath+"/static/public/robots.txt")
 	Routers.File("/sitemap.xml", sitePath+"/static/public/sitemap.xml")
 }
@@ -9,10 +9,25 @@ if [ "$PAUSE_ON_START" = "true" ] ; then
   done
 fi
 
+# Pass SIGTERM on to the server so it can drain its connections, and don't
+# restart it afterwards.
+stopping=false
+trap 'stopping=true; kill -TERM "$pid" 2>/dev/null' TERM INT
+
 while true; do
   echo
   echo "Starting web server:"
-  /go/bin/"$APP_NAME"
-  echo "Sleeping for a 10 seconds before starting the web server again with new certs."
+  /go/bin/"$APP_NAME" &
+  pid=$!
+  # wait returns early when a trapped signal arrives, so keep waiting
+  # until the server has actually finished.
+  while kill -0 "$pid" 2>/dev/null; do
+    wait "$pid" || true
+  done
+  if [ "$stopping" = "true" ]; then
+    echo "Web server stopped."
+    exit 0
+  fi
+  echo "Web server exited, restarting it in 10 seconds."
   sleep 10
 done
\ No newline at end of file
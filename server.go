@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/dedgarsites/dedgar/logging"
+)
+
+var (
+	// httpPort is where plain HTTP requests are redirected to HTTPS, and
+	// ACME HTTP-01 challenges answered. It defaults to ACME_HTTP_PORT, and
+	// to 8080 when certificates come from ACME; "off" disables it.
+	httpPort = os.Getenv("HTTP_PORT")
+	// httpsPort is added to redirect URLs when HTTPS isn't served on 443,
+	// such as when trying the server out locally on 8443.
+	httpsPort = os.Getenv("HTTPS_REDIRECT_PORT")
+	// tlsMinVersion is the oldest TLS version accepted, "1.2" or "1.3".
+	tlsMinVersion = os.Getenv("TLS_MIN_VERSION")
+	// http2Enabled is false when HTTP2 is "off".
+	http2Enabled = os.Getenv("HTTP2") != "off"
+)
+
+// cipherSuites are the TLS 1.2 suites offered: forward secret AEADs only.
+// TLS 1.3 suites aren't configurable and are all fine.
+var cipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// configureTLS sets up s to serve TLS with config, restricted to modern
+// versions and ciphers, speaking HTTP/2 unless it's been turned off.
+func configureTLS(s *http.Server, config *tls.Config) error {
+	config.MinVersion = tls.VersionTLS12
+	if tlsMinVersion == "1.3" {
+		config.MinVersion = tls.VersionTLS13
+	}
+	config.CipherSuites = cipherSuites
+	config.CurvePreferences = []tls.CurveID{tls.X25519, tls.CurveP256}
+
+	// The server's order wins ALPN negotiation, so h2 has to come before
+	// http/1.1. Anything already there, like ACME's TLS-ALPN-01 protocol,
+	// is kept after them.
+	protos := []string{"http/1.1"}
+	if http2Enabled {
+		protos = []string{"h2", "http/1.1"}
+	}
+	for _, proto := range config.NextProtos {
+		if proto != "h2" && proto != "http/1.1" {
+			protos = append(protos, proto)
+		}
+	}
+	config.NextProtos = protos
+
+	s.TLSConfig = config
+	s.ReadHeaderTimeout = 10 * time.Second
+	s.IdleTimeout = 2 * time.Minute
+
+	if !http2Enabled {
+		// A non-nil, empty TLSNextProto keeps net/http from enabling
+		// HTTP/2 on its own.
+		s.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil
+	}
+	return http2.ConfigureServer(s, &http2.Server{
+		MaxConcurrentStreams: 250,
+		IdleTimeout:          s.IdleTimeout,
+	})
+}
+
+// redirectHTTPS permanently redirects every request to the same URL over
+// HTTPS.
+func redirectHTTPS() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		// Only GET and HEAD are safe to repeat as a GET; anything else
+		// keeps its method and body with a 308.
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
+
+// serveHTTP starts the plain HTTP listener on httpPort, if there is one,
+// passing requests to handler.
+func serveHTTP(handler http.Handler, acmeEnabled bool) *http.Server {
+	port := httpPort
+	if port == "" {
+		port = os.Getenv("ACME_HTTP_PORT")
+	}
+	if port == "" && acmeEnabled {
+		port = "8080"
+	}
+	if port == "" || port == "off" {
+		return nil
+	}
+
+	s := &http.Server{
+		Addr:              ":" + port,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+	go func() {
+		if err := s.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Logger.Error("serving HTTP", "err", err)
+		}
+	}()
+	return s
+}
@@ -0,0 +1,169 @@
+package shares
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/limiter"
+	"github.com/dedgarsites/dedgar/models"
+	"github.com/dedgarsites/dedgar/tree"
+
+	"github.com/jinzhu/gorm"
+)
+
+// MaxLifetime is the longest a link can be valid for.
+const MaxLifetime = 365 * 24 * time.Hour
+
+var (
+	ErrInvalid      = errors.New("share link is not valid")
+	ErrExpired      = errors.New("share link has expired")
+	ErrExhausted    = errors.New("share link has no downloads left")
+	ErrBadLifetime  = errors.New("share links must expire within a year")
+	ErrBadPassword  = errors.New("wrong password")
+	ErrRateLimited  = errors.New("too many attempts, try again later")
+	ErrBadDownloads = errors.New("download limit can't be negative")
+	ErrRoot         = errors.New("the whole tree can't be shared")
+
+	// Secret signs link tokens, so guessed or altered ones are turned away
+	// without a database lookup.
+	Secret = []byte(datastores.CookieSecret)
+
+	passwordLimit = limiter.New(10, 15*time.Minute)
+)
+
+// Create stores a link to the tree path name that expires after lifetime.
+// An empty password leaves the link open to anyone who has it.
+func Create(name string, lifetime time.Duration, password string, maxDownloads int, createdBy string) (*models.ShareLink, error) {
+	if lifetime <= 0 || lifetime > MaxLifetime {
+		return nil, ErrBadLifetime
+	}
+	if maxDownloads < 0 {
+		return nil, ErrBadDownloads
+	}
+
+	folder, file, err := tree.Root().Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if folder != nil && folder.Path == "" {
+		return nil, ErrRoot
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	link := models.ShareLink{
+		Key:          hex.EncodeToString(b),
+		ExpiresAt:    time.Now().Add(lifetime),
+		MaxDownloads: maxDownloads,
+		CreatedBy:    createdBy,
+	}
+	if file != nil {
+		link.Path = file.Path
+	} else {
+		link.Path = folder.Path
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		link.PasswordHash = string(hash)
+	}
+
+	if err := datastores.DB.Create(&link).Error; err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// Token is the part of a link's URL that identifies it: its key and a
+// signature over the key.
+func Token(link *models.ShareLink) string {
+	return link.Key + "." + sign(link.Key)
+}
+
+func sign(key string) string {
+	mac := hmac.New(sha256.New, Secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Find returns the link for token if it's still usable.
+func Find(token string) (*models.ShareLink, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(sign(parts[0]))) {
+		return nil, ErrInvalid
+	}
+
+	var link models.ShareLink
+	if datastores.DB.Where(&models.ShareLink{Key: parts[0]}).First(&link).RecordNotFound() || link.Revoked {
+		return nil, ErrInvalid
+	}
+	if time.Now().After(link.ExpiresAt) {
+		return nil, ErrExpired
+	}
+	if link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads {
+		return nil, ErrExhausted
+	}
+	return &link, nil
+}
+
+// CheckPassword reports whether password unlocks link. Attempts are rate
+// limited per link and address to keep passwords from being guessed.
+func CheckPassword(link *models.ShareLink, password, ip string) error {
+	if !passwordLimit.Allow(link.Key + " " + ip) {
+		return ErrRateLimited
+	}
+	if bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) != nil {
+		return ErrBadPassword
+	}
+	return nil
+}
+
+// CountDownload uses up one of link's downloads. The check and increment
+// happen in one statement so concurrent downloads can't overrun the limit.
+func CountDownload(link *models.ShareLink) error {
+	result := datastores.DB.Model(&models.ShareLink{}).
+		Where("id = ? AND (max_downloads = 0 OR downloads < max_downloads)", link.ID).
+		UpdateColumn("downloads", gorm.Expr("downloads + ?", 1))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrExhausted
+	}
+	link.Downloads++
+	return nil
+}
+
+// Contains reports whether the tree path name is within what link shares.
+func Contains(link *models.ShareLink, name string) bool {
+	if strings.HasSuffix(link.Path, "/") {
+		return strings.HasPrefix(name, link.Path)
+	}
+	return name == link.Path
+}
+
+// Active returns the links that haven't expired or been revoked, newest
+// first.
+func Active() []models.ShareLink {
+	var links []models.ShareLink
+	datastores.DB.Where("revoked = ? AND expires_at > ?", false, time.Now()).Order("created_at desc").Find(&links)
+	return links
+}
+
+// Revoke stops the link with the given ID from working.
+func Revoke(id uint) error {
+	return datastores.DB.Model(&models.ShareLink{}).Where("id = ?", id).UpdateColumn("revoked", true).Error
+}
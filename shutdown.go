@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/dedgarsites/dedgar/datastores"
+	"github.com/dedgarsites/dedgar/health"
+	"github.com/dedgarsites/dedgar/logging"
+	"github.com/dedgarsites/dedgar/mailqueue"
+)
+
+var (
+	// shutdownDelay is how long the server keeps taking requests after
+	// SIGTERM while reporting itself not ready, giving the router time to
+	// stop sending it new ones.
+	shutdownDelay = 5 * time.Second
+	// shutdownTimeout is how long in-flight requests, background workers
+	// and the final mail queue flush get to finish once the listeners
+	// close.
+	shutdownTimeout = 20 * time.Second
+)
+
+// workers tracks background goroutines that should finish what they're
+// doing before the process exits.
+type workers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkers() *workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workers{ctx: ctx, cancel: cancel}
+}
+
+// Go runs f until the workers are stopped.
+func (w *workers) Go(f func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		f(w.ctx)
+	}()
+}
+
+// Stop cancels the workers and waits for them to return, or for ctx to be
+// done.
+func (w *workers) Stop(ctx context.Context) {
+	w.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logging.Logger.Error("stopping background workers", "err", ctx.Err())
+	}
+}
+
+// serveUntilSignalled serves e with s, marking the server ready once it's
+// listening, and then drains everything when SIGTERM or SIGINT arrives, or
+// serving fails. redirect is the plain HTTP listener, if there is one, and
+// stopTracing flushes spans once everything else has finished.
+func serveUntilSignalled(e *echo.Echo, s *http.Server, redirect *http.Server, bg *workers, stopTracing func(context.Context) error) {
+	errc := make(chan error, 1)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+
+	// Listening here rather than leaving it to StartServer means the
+	// port is open by the time the server says it's ready.
+	ln, err := (&net.ListenConfig{KeepAlive: 3 * time.Minute}).Listen(context.Background(), "tcp", s.Addr)
+	if err != nil {
+		errc <- err
+	} else {
+		if s.TLSConfig != nil {
+			e.TLSListener = tls.NewListener(ln, s.TLSConfig)
+		} else {
+			e.Listener = ln
+		}
+		go func() {
+			errc <- e.StartServer(s)
+		}()
+		health.SetReady(true)
+	}
+
+	select {
+	case err := <-errc:
+		logging.Logger.Error("serving", "err", err)
+	case s := <-sig:
+		logging.Logger.Info("draining connections", "signal", s.String())
+		health.SetReady(false)
+		time.Sleep(shutdownDelay)
+	}
+	health.SetReady(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if redirect != nil {
+		if err := redirect.Shutdown(ctx); err != nil {
+			logging.Logger.Error("shutting down HTTP listener", "err", err)
+		}
+	}
+	if err := e.Shutdown(ctx); err != nil {
+		logging.Logger.Error("shutting down server", "err", err)
+	}
+
+	bg.Stop(ctx)
+	mailqueue.Flush(ctx)
+
+	if db := datastores.DB.DB(); db != nil {
+		if err := db.Close(); err != nil {
+			logging.Logger.Error("closing database", "err", err)
+		}
+	}
+	if err := stopTracing(ctx); err != nil {
+		logging.Logger.Error("flushing traces", "err", err)
+	}
+}
+
+func init() {
+	if delay, err := time.ParseDuration(os.Getenv("SHUTDOWN_DELAY")); err == nil && delay >= 0 {
+		shutdownDelay = delay
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && timeout > 0 {
+		shutdownTimeout = timeout
+	}
+}
@@ -0,0 +1,108 @@
+package spam
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Bayes is a naive Bayes classifier trained on reviewed submissions. It
+// stays silent until it has seen MinDocs of both spam and ham.
+type Bayes struct {
+	Weight  float64
+	MinDocs int
+
+	mu       sync.RWMutex
+	spam     map[string]int
+	ham      map[string]int
+	spamDocs int
+	hamDocs  int
+}
+
+func NewBayes(weight float64, minDocs int) *Bayes {
+	return &Bayes{
+		Weight:  weight,
+		MinDocs: minDocs,
+		spam:    make(map[string]int),
+		ham:     make(map[string]int),
+	}
+}
+
+func (b *Bayes) Name() string { return "bayes" }
+
+// Train records text as spam or ham.
+func (b *Bayes) Train(text string, isSpam bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	counts := b.ham
+	if isSpam {
+		counts = b.spam
+		b.spamDocs++
+	} else {
+		b.hamDocs++
+	}
+	for token := range tokenize(text) {
+		counts[token]++
+	}
+}
+
+// Check combines the fifteen most telling tokens into a spam probability and
+// scores anything above 0.9.
+func (b *Bayes) Check(s *Submission) (float64, string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.spamDocs < b.MinDocs || b.hamDocs < b.MinDocs {
+		return 0, ""
+	}
+
+	var probs []float64
+	for token := range tokenize(s.Text()) {
+		inSpam := float64(b.spam[token]) / float64(b.spamDocs)
+		inHam := float64(b.ham[token]) / float64(b.hamDocs)
+		if b.spam[token]+b.ham[token] < 2 {
+			continue
+		}
+		p := inSpam / (inSpam + inHam)
+		probs = append(probs, math.Min(0.99, math.Max(0.01, p)))
+	}
+	if len(probs) == 0 {
+		return 0, ""
+	}
+
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > 15 {
+		probs = probs[:15]
+	}
+
+	// Combine in log space to avoid underflow.
+	var logSpam, logHam float64
+	for _, p := range probs {
+		logSpam += math.Log(p)
+		logHam += math.Log(1 - p)
+	}
+	prob := 1 / (1 + math.Exp(logHam-logSpam))
+
+	if prob > 0.9 {
+		return b.Weight, fmt.Sprintf("spam probability %.2f", prob)
+	}
+	return 0, ""
+}
+
+func tokenize(text string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '$' && r != '\''
+	}) {
+		if len(word) > 2 && len(word) < 30 {
+			tokens[word] = true
+		}
+	}
+	return tokens
+}
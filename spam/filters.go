@@ -0,0 +1,169 @@
+package spam
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dedgarsites/dedgar/limiter"
+)
+
+// Reject is the score filters give when a single failure should be enough to
+// quarantine a submission.
+const Reject = 100
+
+var linkPattern = regexp.MustCompile(`(?i)(https?://|www\.)[^\s"'<>]*`)
+
+// Honeypot flags submissions that filled in a field hidden from people.
+type Honeypot struct {
+	Field string
+}
+
+func (h Honeypot) Name() string { return "honeypot" }
+
+func (h Honeypot) Check(s *Submission) (float64, string) {
+	if s.Hidden[h.Field] != "" {
+		return Reject, "hidden field " + h.Field + " was filled in"
+	}
+	return 0, ""
+}
+
+// FillTime flags forms submitted faster than a person could type them, using
+// a signed timestamp handed out when the form was rendered. Tokens older than
+// Max are treated as replayed.
+type FillTime struct {
+	Field  string
+	Secret []byte
+	Min    time.Duration
+	Max    time.Duration
+}
+
+func (f FillTime) Name() string { return "fill_time" }
+
+// Token returns a token recording that the form was rendered at t.
+func (f FillTime) Token(t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return ts + "." + f.sign(ts)
+}
+
+func (f FillTime) sign(ts string) string {
+	mac := hmac.New(sha256.New, f.Secret)
+	mac.Write([]byte(ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f FillTime) Check(s *Submission) (float64, string) {
+	parts := strings.SplitN(s.Hidden[f.Field], ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(f.sign(parts[0]))) {
+		return Reject, "missing or invalid form token"
+	}
+
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Reject, "malformed form token"
+	}
+
+	elapsed := time.Since(time.Unix(unix, 0))
+	if elapsed < f.Min {
+		return Reject, fmt.Sprintf("form filled in %s", elapsed.Round(time.Millisecond))
+	}
+	if f.Max > 0 && elapsed > f.Max {
+		return Reject, "form token expired"
+	}
+	return 0, ""
+}
+
+// Links scores each link beyond Max, ignoring links to any of the Allow
+// hosts or their subdomains.
+type Links struct {
+	Max   int
+	Allow []string
+	Each  float64
+}
+
+func (l Links) Name() string { return "links" }
+
+func (l Links) Check(s *Submission) (float64, string) {
+	count := 0
+	for _, link := range linkPattern.FindAllString(s.Text(), -1) {
+		if !l.Allowed(link) {
+			count++
+		}
+	}
+	if count > l.Max {
+		return float64(count-l.Max) * l.Each, fmt.Sprintf("%d links", count)
+	}
+	return 0, ""
+}
+
+// Allowed reports whether link points at one of the Allow hosts.
+func (l Links) Allowed(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allow := range l.Allow {
+		allow = strings.ToLower(allow)
+		if host == allow || strings.HasSuffix(host, "."+allow) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keywords adds the weight of each listed word or phrase found in the
+// submission.
+type Keywords struct {
+	Weights map[string]float64
+}
+
+func (k Keywords) Name() string { return "keywords" }
+
+func (k Keywords) Check(s *Submission) (float64, string) {
+	text := strings.ToLower(s.Text())
+
+	words := make([]string, 0, len(k.Weights))
+	for word := range k.Weights {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+
+	var score float64
+	var found []string
+	for _, word := range words {
+		if strings.Contains(text, word) {
+			score += k.Weights[word]
+			found = append(found, word)
+		}
+	}
+	if score > 0 {
+		return score, "matched " + strings.Join(found, ", ")
+	}
+	return 0, ""
+}
+
+// RateLimit flags addresses that submit more often than the limiter allows.
+type RateLimit struct {
+	Limiter *limiter.Limiter
+}
+
+func (r RateLimit) Name() string { return "rate_limit" }
+
+func (r RateLimit) Check(s *Submission) (float64, string) {
+	if !r.Limiter.Allow(s.IP) {
+		return Reject, "too many submissions from " + s.IP
+	}
+	return 0, ""
+}
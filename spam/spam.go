@@ -0,0 +1,79 @@
+package spam
+
+import (
+	"strings"
+)
+
+// Submission is a form post run through a Chain. Fields holds what the
+// person wrote, Hidden holds fields the page filled in on their behalf such as
+// honeypots and form tokens.
+type Submission struct {
+	IP     string
+	Fields map[string]string
+	Hidden map[string]string
+}
+
+// Text joins the written fields so content filters can look at all of them.
+func (s *Submission) Text() string {
+	var parts []string
+	for _, v := range s.Fields {
+		parts = append(parts, v)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Verdict is what one filter had to say about a submission.
+type Verdict struct {
+	Filter string
+	Score  float64
+	Reason string
+}
+
+// Filter scores a submission. A score of zero means the filter found nothing
+// wrong; anything at or over the chain's threshold is enough on its own to
+// quarantine the submission.
+type Filter interface {
+	Name() string
+	Check(s *Submission) (score float64, reason string)
+}
+
+// Chain runs every filter and adds up their scores.
+type Chain struct {
+	Filters   []Filter
+	Threshold float64
+}
+
+// Check returns whether the submission scored at or above the threshold,
+// along with the verdicts of every filter that scored it.
+func (ch *Chain) Check(s *Submission) (bool, []Verdict) {
+	var total float64
+	var verdicts []Verdict
+
+	for _, f := range ch.Filters {
+		score, reason := f.Check(s)
+		if score <= 0 {
+			continue
+		}
+		total += score
+		verdicts = append(verdicts, Verdict{Filter: f.Name(), Score: score, Reason: reason})
+	}
+	return total >= ch.Threshold, verdicts
+}
+
+// Reasons flattens verdicts into a single line for storage and review.
+func Reasons(verdicts []Verdict) string {
+	var reasons []string
+	for _, v := range verdicts {
+		reasons = append(reasons, v.Filter+": "+v.Reason)
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// Score adds up the scores of verdicts.
+func Score(verdicts []Verdict) float64 {
+	var total float64
+	for _, v := range verdicts {
+		total += v.Score
+	}
+	return total
+}
@@ -0,0 +1,89 @@
+// Sends the files picked in a tree listing through the resumable upload
+// API in chunks, so large files survive a flaky connection. An interrupted
+// upload carries on from where it stopped the next time the same file is
+// picked.
+(function () {
+  var form = document.getElementById('tree-upload');
+  if (!form || !window.fetch || !window.Promise) {
+    return;
+  }
+  var progress = document.getElementById('tree-upload-progress');
+  var chunkSize = 8 * 1024 * 1024;
+
+  function json(res) {
+    return res.json().then(function (body) {
+      if (!res.ok) {
+        throw new Error(body.error || res.statusText);
+      }
+      return body;
+    });
+  }
+
+  function send(upload, file, key) {
+    progress.textContent = file.name + ': ' + Math.floor(100 * upload.offset / (file.size || 1)) + '%';
+    var end = Math.min(upload.offset + chunkSize, file.size);
+    return fetch('/api/admin/tree/uploads/' + upload.id, {
+      method: 'PUT',
+      headers: {'Upload-Offset': String(upload.offset)},
+      body: file.slice(upload.offset, end)
+    }).then(function (res) {
+      if (res.status === 201) {
+        localStorage.removeItem(key);
+        return json(res);
+      }
+      return res.json().then(function (body) {
+        if (res.status === 409 && body.offset !== undefined) {
+          upload.offset = body.offset;
+          return send(upload, file, key);
+        }
+        if (!res.ok) {
+          throw new Error(body.error || res.statusText);
+        }
+        return send(body, file, key);
+      });
+    });
+  }
+
+  function start(path, file) {
+    var key = 'tree-upload:' + path + ':' + file.size + ':' + file.lastModified;
+    var id = localStorage.getItem(key);
+    var resume = Promise.resolve(null);
+    if (id) {
+      resume = fetch('/api/admin/tree/uploads/' + id).then(function (res) {
+        return res.ok ? res.json() : null;
+      });
+    }
+
+    return resume.then(function (upload) {
+      if (upload) {
+        return upload;
+      }
+      return fetch('/api/admin/tree/uploads', {
+        method: 'POST',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({path: path, size: file.size})
+      }).then(json).then(function (upload) {
+        localStorage.setItem(key, upload.id);
+        return upload;
+      });
+    }).then(function (upload) {
+      return send(upload, file, key);
+    });
+  }
+
+  form.addEventListener('submit', function (e) {
+    e.preventDefault();
+    var folder = form.elements.folder.value;
+    var files = Array.prototype.slice.call(form.elements.file.files);
+
+    files.reduce(function (done, file) {
+      return done.then(function () {
+        return start(folder + file.name, file);
+      });
+    }, Promise.resolve()).then(function () {
+      location.reload();
+    }).catch(function (err) {
+      progress.textContent = 'Upload failed: ' + err.message + '. Pick the file again to resume.';
+    });
+  });
+})();
@@ -0,0 +1,184 @@
+package thumbs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	xdraw "golang.org/x/image/draw"
+
+	"github.com/dedgarsites/dedgar/tree"
+)
+
+var (
+	// Dir is where generated thumbnails are cached, set with THUMB_CACHE.
+	Dir = filepath.Join(os.TempDir(), "dedgar-thumbs")
+	// Sizes are the bounding boxes, in pixels, thumbnails can be made at.
+	Sizes = []int{128, 256, 512}
+	// DefaultSize is used when a request doesn't ask for one of Sizes.
+	DefaultSize = 256
+	// MaxPixels caps the dimensions of source images we're willing to
+	// decode, so one huge or malicious upload can't exhaust memory.
+	MaxPixels = 50 * 1000 * 1000
+
+	// ErrUnsupported is returned for files that aren't JPEG, PNG or GIF
+	// images.
+	ErrUnsupported = errors.New("thumbnails are not supported for this file")
+	// ErrTooLarge is returned for images with more than MaxPixels pixels.
+	ErrTooLarge = errors.New("image is too large to thumbnail")
+
+	mu      sync.Mutex
+	pending = make(map[string]*build)
+)
+
+// build is a thumbnail being generated, shared by every request for it.
+type build struct {
+	done chan struct{}
+	err  error
+}
+
+// Supported reports whether thumbnails can be generated for mimeType.
+func Supported(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// ValidSize returns size if it's one of Sizes, otherwise DefaultSize.
+func ValidSize(size int) int {
+	for _, s := range Sizes {
+		if s == size {
+			return s
+		}
+	}
+	return DefaultSize
+}
+
+// Get returns the path to a cached JPEG thumbnail of file that fits within
+// size by size pixels, reading the original from store and generating it
+// first if needed. The cache key includes the file's hash, so thumbnails of
+// replaced files are regenerated rather than served stale.
+func Get(store tree.Store, file *tree.File, size int) (string, error) {
+	if !Supported(file.MIMEType) {
+		return "", ErrUnsupported
+	}
+
+	name := filepath.Join(Dir, cacheKey(file, size)+".jpg")
+	if _, err := os.Stat(name); err == nil {
+		return name, nil
+	}
+
+	// Only one request generates a given thumbnail; the rest wait for it.
+	mu.Lock()
+	if b, ok := pending[name]; ok {
+		mu.Unlock()
+		<-b.done
+		return name, b.err
+	}
+	b := &build{done: make(chan struct{})}
+	pending[name] = b
+	mu.Unlock()
+
+	b.err = generate(store, file.Path, name, size)
+
+	mu.Lock()
+	delete(pending, name)
+	mu.Unlock()
+	close(b.done)
+
+	return name, b.err
+}
+
+func cacheKey(file *tree.File, size int) string {
+	sum := sha1.Sum([]byte(file.Path + "\x00" + file.Hash + "\x00" + file.ModTime.String() + "\x00" + strconv.Itoa(size)))
+	return hex.EncodeToString(sum[:])
+}
+
+func generate(store tree.Store, src, dst string, size int) error {
+	f, _, err := store.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return ErrUnsupported
+	}
+	if config.Width*config.Height > MaxPixels {
+		return ErrTooLarge
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("decoding %s: %v", src, err)
+	}
+
+	if err := os.MkdirAll(Dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(Dir, ".thumb-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := jpeg.Encode(tmp, Resize(img, size), &jpeg.Options{Quality: 85}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// Resize scales img down to fit within size by size pixels, keeping its
+// aspect ratio, and flattens any transparency onto white. Images that
+// already fit are only flattened.
+func Resize(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+func init() {
+	if dir := os.Getenv("THUMB_CACHE"); dir != "" {
+		Dir = dir
+	}
+}
@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	contextKey = "tracing:context"
+	spanKey    = "tracing:span"
+)
+
+// DB returns db with ctx attached, so statements run through it are
+// traced as children of the span in ctx. gorm v1 has no context of its own.
+func DB(ctx context.Context, db *gorm.DB) *gorm.DB {
+	return db.Set(contextKey, ctx)
+}
+
+// InstrumentDB traces statements run through a db returned by DB.
+// Statements without a context aren't traced, so background polling
+// doesn't produce a trace of its own every few seconds.
+func InstrumentDB(db *gorm.DB) {
+	before := func(operation string) func(scope *gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			value, ok := scope.Get(contextKey)
+			if !ok {
+				return
+			}
+			ctx, ok := value.(context.Context)
+			if !ok || !trace.SpanContextFromContext(ctx).IsValid() {
+				return
+			}
+			_, span := Tracer.Start(ctx, "gorm."+operation,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					attribute.String("db.operation.name", operation),
+					attribute.String("db.collection.name", scope.TableName()),
+				))
+			scope.Set(spanKey, span)
+		}
+	}
+	after := func(scope *gorm.Scope) {
+		value, ok := scope.Get(spanKey)
+		if !ok {
+			return
+		}
+		span := value.(trace.Span)
+		// Only the statement is recorded; its arguments can hold
+		// passwords and message bodies.
+		span.SetAttributes(
+			attribute.String("db.query.text", scope.SQL),
+			attribute.Int64("db.response.returned_rows", scope.DB().RowsAffected),
+		)
+		if err := scope.DB().Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+
+	callbacks := db.Callback()
+	callbacks.Create().Before("gorm:begin_transaction").Register("tracing:before_create", before("create"))
+	callbacks.Create().After("gorm:commit_or_rollback_transaction").Register("tracing:after_create", after)
+	callbacks.Query().Before("gorm:query").Register("tracing:before_query", before("query"))
+	callbacks.Query().After("gorm:after_query").Register("tracing:after_query", after)
+	callbacks.Update().Before("gorm:begin_transaction").Register("tracing:before_update", before("update"))
+	callbacks.Update().After("gorm:commit_or_rollback_transaction").Register("tracing:after_update", after)
+	callbacks.Delete().Before("gorm:begin_transaction").Register("tracing:before_delete", before("delete"))
+	callbacks.Delete().After("gorm:commit_or_rollback_transaction").Register("tracing:after_delete", after)
+	callbacks.RowQuery().Before("gorm:row_query").Register("tracing:before_row_query", before("row_query"))
+	callbacks.RowQuery().After("gorm:row_query").Register("tracing:after_row_query", after)
+}
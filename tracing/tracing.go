@@ -0,0 +1,127 @@
+// Package tracing records OpenTelemetry spans for requests, database
+// queries, outbound HTTP calls and mail delivery.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporter picks where spans go, from OTEL_TRACES_EXPORTER: "otlp" sends
+// them to the collector at OTEL_EXPORTER_OTLP_ENDPOINT over HTTP, "stdout"
+// writes them to stderr for local inspection, and anything else, including
+// the default "none", turns tracing off.
+var Exporter = os.Getenv("OTEL_TRACES_EXPORTER")
+
+// Tracer starts the site's spans. It follows whatever provider Setup
+// installs, and records nothing until then.
+var Tracer = otel.Tracer("github.com/dedgarsites/dedgar")
+
+// Client is an HTTP client whose requests are traced as children of the
+// span in their context.
+var Client = &http.Client{Transport: Transport(http.DefaultTransport)}
+
+// Setup installs the provider for Exporter. The returned function flushes
+// and stops it. Sampling and the service name can be set with the usual
+// OTEL_TRACES_SAMPLER and OTEL_SERVICE_NAME variables.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch Exporter {
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr), stdouttrace.WithPrettyPrint())
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating %s trace exporter: %v", Exporter, err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "dedgar")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Transport traces requests made through base.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
+
+// Middleware starts a server span for every request, continuing any trace
+// the caller propagated, and puts it in the request's context.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+			// The route isn't known until the router has run, so the span
+			// is renamed once the handler returns.
+			ctx, span := Tracer.Start(ctx, req.Method, trace.WithSpanKind(trace.SpanKindServer))
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			if err != nil && !c.Response().Committed {
+				c.Error(err)
+			}
+
+			route := c.Path()
+			status := c.Response().Status
+			span.SetName(req.Method + " " + route)
+			span.SetAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("http.route", route),
+				attribute.Int("http.response.status_code", status),
+				attribute.String("client.address", c.RealIP()),
+			)
+			if status >= 500 {
+				span.SetStatus(codes.Error, strconv.Itoa(status))
+				if err != nil {
+					span.RecordError(err)
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// End records err, if there is one, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
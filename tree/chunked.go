@@ -0,0 +1,224 @@
+package tree
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ChunkDir holds uploads in progress, set with TREE_UPLOAD_DIR. Uploads
+	// are kept on disk so they can be resumed after a dropped connection or
+	// a restart.
+	ChunkDir = filepath.Join(os.TempDir(), "dedgar-uploads")
+	// MaxUploadSize caps the size of a single file, set in bytes with
+	// TREE_MAX_UPLOAD.
+	MaxUploadSize int64 = 5 << 30
+	// UploadExpiry is how long an unfinished upload is kept after its last
+	// chunk.
+	UploadExpiry = 24 * time.Hour
+
+	// ErrUploadNotFound is returned for unknown or expired upload IDs.
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrTooLarge is returned for uploads bigger than MaxUploadSize, or
+	// chunks that run past the size the upload was started with.
+	ErrTooLarge = errors.New("upload is too large")
+
+	chunkLocks sync.Map
+)
+
+// OffsetError is returned when a chunk doesn't start where the previous one
+// ended. Offset is where the next chunk has to start.
+type OffsetError struct {
+	Offset int64
+}
+
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("chunk must start at offset %d", e.Offset)
+}
+
+// ChunkedUpload is a file being uploaded in pieces. Offset is how much has
+// been received so far.
+type ChunkedUpload struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Offset  int64     `json:"offset"`
+	Updated time.Time `json:"updated"`
+}
+
+func chunkFiles(id string) (data, meta string) {
+	base := filepath.Join(ChunkDir, id)
+	return base + ".part", base + ".json"
+}
+
+// StartUpload begins a chunked upload of size bytes to name.
+func StartUpload(name string, size int64) (*ChunkedUpload, error) {
+	if _, err := writable(); err != nil {
+		return nil, err
+	}
+	name, err := writableName(name)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > MaxUploadSize {
+		return nil, ErrTooLarge
+	}
+	if folder, _, err := Root().Resolve(name); err == nil && folder != nil {
+		return nil, ErrExists
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	upload := &ChunkedUpload{ID: hex.EncodeToString(b), Path: name, Size: size, Updated: time.Now()}
+
+	if err := os.MkdirAll(ChunkDir, 0700); err != nil {
+		return nil, err
+	}
+	data, meta := chunkFiles(upload.ID)
+	if err := ioutil.WriteFile(data, nil, 0600); err != nil {
+		return nil, err
+	}
+	contents, err := json.Marshal(upload)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(meta, contents, 0600); err != nil {
+		os.Remove(data)
+		return nil, err
+	}
+	return upload, nil
+}
+
+// GetUpload returns the progress of the upload id.
+func GetUpload(id string) (*ChunkedUpload, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return nil, ErrUploadNotFound
+	}
+
+	data, meta := chunkFiles(id)
+	contents, err := ioutil.ReadFile(meta)
+	if err != nil {
+		return nil, ErrUploadNotFound
+	}
+	var upload ChunkedUpload
+	if err := json.Unmarshal(contents, &upload); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(data)
+	if err != nil {
+		return nil, ErrUploadNotFound
+	}
+	upload.Offset = info.Size()
+	upload.Updated = info.ModTime()
+	return &upload, nil
+}
+
+// WriteChunk appends r to the upload id. The chunk has to start at offset,
+// which must match what's been received so far. Once the last byte arrives
+// the file is stored in the tree and returned.
+func WriteChunk(id string, offset int64, r io.Reader) (*ChunkedUpload, *File, error) {
+	lock, _ := chunkLocks.LoadOrStore(id, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	upload, err := GetUpload(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset != upload.Offset {
+		return upload, nil, &OffsetError{Offset: upload.Offset}
+	}
+
+	data, _ := chunkFiles(id)
+	f, err := os.OpenFile(data, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Read one byte past the end so an oversized chunk is noticed, then
+	// throw away the whole chunk so the client can retry it.
+	remaining := upload.Size - upload.Offset
+	n, err := io.Copy(f, io.LimitReader(r, remaining+1))
+	if err == nil && n > remaining {
+		err = ErrTooLarge
+	}
+	if err != nil {
+		f.Truncate(upload.Offset)
+		f.Close()
+		return upload, nil, err
+	}
+	if err := f.Close(); err != nil {
+		return upload, nil, err
+	}
+	upload.Offset += n
+	upload.Updated = time.Now()
+
+	if upload.Offset < upload.Size {
+		return upload, nil, nil
+	}
+
+	f, err = os.Open(data)
+	if err != nil {
+		return upload, nil, err
+	}
+	defer f.Close()
+
+	file, err := Upload(upload.Path, f)
+	if err != nil {
+		return upload, nil, err
+	}
+	CancelUpload(id)
+	return upload, file, nil
+}
+
+// CancelUpload throws away the upload id and everything received for it.
+func CancelUpload(id string) error {
+	if _, err := GetUpload(id); err != nil {
+		return err
+	}
+	data, meta := chunkFiles(id)
+	os.Remove(meta)
+	chunkLocks.Delete(id)
+	return os.Remove(data)
+}
+
+// ExpireUploads removes uploads that haven't had a chunk in UploadExpiry.
+func ExpireUploads() {
+	matches, err := filepath.Glob(filepath.Join(ChunkDir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, meta := range matches {
+		id := filepath.Base(meta[:len(meta)-len(".json")])
+		upload, err := GetUpload(id)
+		if err == nil && time.Since(upload.Updated) < UploadExpiry {
+			continue
+		}
+		data, _ := chunkFiles(id)
+		os.Remove(data)
+		os.Remove(meta)
+		chunkLocks.Delete(id)
+	}
+}
+
+func init() {
+	if dir := os.Getenv("TREE_UPLOAD_DIR"); dir != "" {
+		ChunkDir = dir
+	}
+	if size, err := strconv.ParseInt(os.Getenv("TREE_MAX_UPLOAD"), 10, 64); err == nil && size > 0 {
+		MaxUploadSize = size
+	}
+}
@@ -0,0 +1,246 @@
+package tree
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ErrExists is returned when an edit would replace a folder, or move
+// something onto a name that's already taken.
+var ErrExists = errors.New("already exists in tree")
+
+// ErrIntoItself is returned when moving a folder somewhere inside itself.
+var ErrIntoItself = errors.New("cannot move a folder into itself")
+
+// Edits go to DefaultStore first and are then applied to a copy of the
+// in-memory tree, which replaces the current one. Readers holding the old
+// tree from Root are never disturbed, and the tree reflects the edit
+// without waiting for the next Refresh.
+
+// editMu serializes edits, so the checks each one makes against the tree
+// still hold when it reaches the store. It's separate from mu so readers
+// aren't held up while an upload is written.
+var editMu sync.Mutex
+
+func writable() (WritableStore, error) {
+	store, ok := DefaultStore.(WritableStore)
+	if !ok {
+		return nil, ErrReadOnly
+	}
+	return store, nil
+}
+
+// Upload stores the contents of r as the file name, creating any missing
+// folders on the way and replacing an existing file of the same name.
+func Upload(name string, r io.ReadSeeker) (*File, error) {
+	store, err := writable()
+	if err != nil {
+		return nil, err
+	}
+	if name, err = writableName(name); err != nil {
+		return nil, err
+	}
+
+	editMu.Lock()
+	defer editMu.Unlock()
+
+	if folder, _, err := Root().Resolve(name); err == nil && folder != nil {
+		return nil, ErrExists
+	}
+
+	entry, err := store.Put(name, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var file File
+	update(func(root *Folder) {
+		parent := root.mkdirAll(parentName(name))
+		file = *parent.putFile(path.Base(name), entry)
+	})
+	return &file, nil
+}
+
+// Mkdir creates the folder name along with any missing parents.
+func Mkdir(name string) (*Folder, error) {
+	store, err := writable()
+	if err != nil {
+		return nil, err
+	}
+	if name, err = writableName(name); err != nil {
+		return nil, err
+	}
+
+	editMu.Lock()
+	defer editMu.Unlock()
+
+	if _, _, err := Root().Resolve(name); err == nil {
+		return nil, ErrExists
+	}
+
+	if err := store.Mkdir(name); err != nil {
+		return nil, err
+	}
+
+	var folder *Folder
+	update(func(root *Folder) {
+		folder = root.mkdirAll(name)
+	})
+	return folder, nil
+}
+
+// Move renames the file or folder from to to, which may be in a different
+// folder. Nothing may already exist at to.
+func Move(from, to string) error {
+	store, err := writable()
+	if err != nil {
+		return err
+	}
+	if from, err = writableName(from); err != nil {
+		return err
+	}
+	if to, err = writableName(to); err != nil {
+		return err
+	}
+	if to == from || strings.HasPrefix(to, from+"/") {
+		return ErrIntoItself
+	}
+
+	editMu.Lock()
+	defer editMu.Unlock()
+
+	root := Root()
+	if _, _, err := root.Resolve(from); err != nil {
+		return err
+	}
+	if _, _, err := root.Resolve(to); err == nil {
+		return ErrExists
+	}
+
+	if err := store.Move(from, to); err != nil {
+		return err
+	}
+
+	update(func(root *Folder) {
+		folder, file := root.mkdirAll(parentName(from)).detach(path.Base(from))
+		parent := root.mkdirAll(parentName(to))
+		name := path.Base(to)
+
+		if folder != nil {
+			folder.Name = name
+			folder.rebase(parent.Path + name + "/")
+			parent.Folders[name] = folder
+		}
+		if file != nil {
+			parent.putFile(name, Entry{
+				Size:     file.Size,
+				ModTime:  file.ModTime,
+				MIMEType: file.MIMEType,
+				Hash:     file.Hash,
+			})
+		}
+	})
+	return nil
+}
+
+// Delete removes the file or folder name, and everything in it.
+func Delete(name string) error {
+	store, err := writable()
+	if err != nil {
+		return err
+	}
+	if name, err = writableName(name); err != nil {
+		return err
+	}
+
+	editMu.Lock()
+	defer editMu.Unlock()
+
+	if _, _, err := Root().Resolve(name); err != nil {
+		return err
+	}
+
+	if err := store.Delete(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	update(func(root *Folder) {
+		root.mkdirAll(parentName(name)).detach(path.Base(name))
+	})
+	return nil
+}
+
+// update applies edit to a copy of the current tree and swaps it in.
+func update(edit func(root *Folder)) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	root := rootFolder.clone()
+	edit(root)
+	root.summarize()
+	rootFolder = root
+	generation++
+}
+
+// clone returns a deep copy of f.
+func (f *Folder) clone() *Folder {
+	c := *f
+	c.Files = append([]File{}, f.Files...)
+	c.Folders = make(map[string]*Folder, len(f.Folders))
+	for name, folder := range f.Folders {
+		c.Folders[name] = folder.clone()
+	}
+	return &c
+}
+
+// mkdirAll returns the folder at the slash separated name below f,
+// creating any that are missing.
+func (f *Folder) mkdirAll(name string) *Folder {
+	folder := f
+	for _, segment := range DeleteEmptyElements(strings.Split(name, "/")) {
+		folder.addFolder(segment)
+		folder = folder.getFolder(segment)
+	}
+	return folder
+}
+
+// putFile adds a file to f, replacing any existing file with that name.
+func (f *Folder) putFile(name string, entry Entry) *File {
+	f.detach(name)
+	f.addFile(name, entry)
+	return &f.Files[len(f.Files)-1]
+}
+
+// detach removes the child called name from f and returns it.
+func (f *Folder) detach(name string) (*Folder, *File) {
+	if folder, ok := f.Folders[name]; ok {
+		delete(f.Folders, name)
+		return folder, nil
+	}
+	for i := range f.Files {
+		if f.Files[i].Name == name {
+			file := f.Files[i]
+			f.Files = append(f.Files[:i], f.Files[i+1:]...)
+			return nil, &file
+		}
+	}
+	return nil, nil
+}
+
+// rebase moves f and everything under it to the folder path p, updating
+// their paths and IDs.
+func (f *Folder) rebase(p string) {
+	f.Path = p
+	f.ID = pathID(p)
+	for i := range f.Files {
+		f.Files[i].Path = p + f.Files[i].Name
+		f.Files[i].ID = pathID(f.Files[i].Path)
+	}
+	for name, folder := range f.Folders {
+		folder.rebase(p + name + "/")
+	}
+}
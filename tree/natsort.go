@@ -0,0 +1,63 @@
+package tree
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NaturalLess reports whether a sorts before b when runs of digits are
+// compared by their numeric value, so "track2" comes before "track10".
+// Letters compare case-insensitively; names that are otherwise equal fall
+// back to a plain byte comparison so the order is always total.
+func NaturalLess(a, b string) bool {
+	x, y := a, b
+	for x != "" && y != "" {
+		if isDigit(x[0]) && isDigit(y[0]) {
+			var dx, dy string
+			dx, x = digitRun(x)
+			dy, y = digitRun(y)
+			if c := compareNumbers(dx, dy); c != 0 {
+				return c < 0
+			}
+			continue
+		}
+
+		rx, nx := utf8.DecodeRuneInString(x)
+		ry, ny := utf8.DecodeRuneInString(y)
+		if lx, ly := unicode.ToLower(rx), unicode.ToLower(ry); lx != ly {
+			return lx < ly
+		}
+		x, y = x[nx:], y[ny:]
+	}
+	if len(x) != len(y) {
+		return len(x) < len(y)
+	}
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func digitRun(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// compareNumbers compares two runs of decimal digits of any length by value,
+// treating "007" and "7" as equal.
+func compareNumbers(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,160 @@
+package tree
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SearchOptions controls Folder.Search. Pattern is matched against names
+// case-insensitively: as a glob when it contains *, ? or [, otherwise as a
+// substring. Type limits matches to "file" or "folder". If Limit is
+// positive only the first Limit matches by path are returned. Folders are
+// scanned with up to Workers goroutines.
+type SearchOptions struct {
+	Pattern string
+	Type    string
+	Limit   int
+	Workers int
+}
+
+// DefaultSearchWorkers is used when SearchOptions.Workers isn't set.
+var DefaultSearchWorkers = 4
+
+// searcher is the state shared by the workers of one search. Folders
+// waiting to be scanned sit in queue; active counts the ones being scanned
+// right now, so workers can tell an empty queue apart from a finished
+// search.
+type searcher struct {
+	ctx   context.Context
+	opts  SearchOptions
+	match func(name string) bool
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*Folder
+	active  int
+	stopped bool
+	results []Item
+}
+
+// Search finds the files and folders below f whose names match
+// opts.Pattern. It returns early with ctx.Err() if ctx is cancelled, along
+// with whatever was found up to then. Results are sorted by path.
+func (f *Folder) Search(ctx context.Context, opts SearchOptions) ([]Item, error) {
+	match, err := matcher(opts.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultSearchWorkers
+	}
+
+	s := &searcher{ctx: ctx, opts: opts, match: match, queue: []*Folder{f}}
+	s.cond = sync.NewCond(&s.mu)
+
+	// Workers waiting on the condition can't watch ctx themselves.
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.stop()
+		case <-finished:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work()
+		}()
+	}
+	wg.Wait()
+	close(finished)
+
+	// Every match has to be found before truncating, since workers find
+	// them in no particular order.
+	results := s.results
+	sort.Slice(results, func(i, j int) bool {
+		return NaturalLess(results[i].Path, results[j].Path)
+	})
+	if opts.Limit > 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+	return results, ctx.Err()
+}
+
+func matcher(pattern string) (func(string) bool, error) {
+	pattern = strings.ToLower(pattern)
+	if strings.ContainsAny(pattern, "*?[") {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+		return func(name string) bool {
+			ok, _ := path.Match(pattern, strings.ToLower(name))
+			return ok
+		}, nil
+	}
+	return func(name string) bool {
+		return strings.Contains(strings.ToLower(name), pattern)
+	}, nil
+}
+
+func (s *searcher) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *searcher) work() {
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && s.active > 0 && !s.stopped {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 || s.stopped || s.ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+		folder := s.queue[len(s.queue)-1]
+		s.queue = s.queue[:len(s.queue)-1]
+		s.active++
+		s.mu.Unlock()
+
+		found, subfolders := s.scan(folder)
+
+		s.mu.Lock()
+		s.results = append(s.results, found...)
+		s.queue = append(s.queue, subfolders...)
+		s.active--
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// scan matches the direct children of folder, returning the matches and
+// the subfolders still to be searched.
+func (s *searcher) scan(folder *Folder) ([]Item, []*Folder) {
+	var found []Item
+	subfolders := make([]*Folder, 0, len(folder.Folders))
+
+	for _, sub := range folder.Folders {
+		subfolders = append(subfolders, sub)
+		if s.opts.Type != "file" && s.match(sub.Name) {
+			found = append(found, sub.Item())
+		}
+	}
+	if s.opts.Type != "folder" {
+		for _, file := range folder.Files {
+			if s.match(file.Name) {
+				found = append(found, file.Item())
+			}
+		}
+	}
+	return found, subfolders
+}
@@ -0,0 +1,432 @@
+package tree
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/dedgarsites/dedgar/logging"
+)
+
+// Entry is one object in a Store. Paths are slash separated and relative to
+// the root of the store, with folders ending in "/".
+type Entry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// ETag is set by stores that already have a validator for the
+	// object's contents.
+	ETag     string
+	MIMEType string
+	Hash     string
+}
+
+// Store lists the objects the tree is built from and opens them for
+// reading. Open returns an error satisfying os.IsNotExist for unknown paths.
+type Store interface {
+	List() ([]Entry, error)
+	Open(name string) (io.ReadSeekCloser, Entry, error)
+}
+
+// StaticStore is a fixed list of entries, handy as a stand-in for a real
+// store during development. It has no contents to open.
+type StaticStore []Entry
+
+func (s StaticStore) List() ([]Entry, error) {
+	entries := make([]Entry, len(s))
+	for i, entry := range s {
+		if entry.MIMEType == "" && !strings.HasSuffix(entry.Path, "/") {
+			entry.MIMEType = mimeByExt(entry.Path)
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+func (s StaticStore) Open(name string) (io.ReadSeekCloser, Entry, error) {
+	return nil, Entry{}, os.ErrNotExist
+}
+
+// mimeByExt guesses a MIME type from the file extension, falling back to
+// application/octet-stream.
+func mimeByExt(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+type fileHash struct {
+	size     int64
+	modTime  time.Time
+	hash     string
+	mimeType string
+}
+
+var (
+	hashMu sync.Mutex
+	// hashCache keeps hashes between refreshes so only new or changed files
+	// are read again.
+	hashCache = make(map[string]fileHash)
+)
+
+// fileMeta returns the SHA-256 of the file at path and its MIME type,
+// sniffing the contents when the extension doesn't give it away.
+func fileMeta(path string, info os.FileInfo) (string, string, error) {
+	hashMu.Lock()
+	cached, ok := hashCache[path]
+	hashMu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.hash, cached.mimeType, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", mimeByExt(path), err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", mimeByExt(path), err
+	}
+	head = head[:n]
+
+	mimeType := mime.TypeByExtension(filepath.Ext(path))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(head)
+	}
+
+	h := sha256.New()
+	h.Write(head)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", mimeType, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	hashMu.Lock()
+	hashCache[path] = fileHash{size: info.Size(), modTime: info.ModTime(), hash: sum, mimeType: mimeType}
+	hashMu.Unlock()
+	return sum, mimeType, nil
+}
+
+// forgetHashes drops cached hashes of files under root that have gone away.
+func forgetHashes(root string, seen map[string]bool) {
+	hashMu.Lock()
+	defer hashMu.Unlock()
+
+	prefix := filepath.Clean(root) + string(filepath.Separator)
+	for path := range hashCache {
+		if strings.HasPrefix(path, prefix) && !seen[path] {
+			delete(hashCache, path)
+		}
+	}
+}
+
+// cleanName normalizes a slash separated path from a request, refusing
+// anything that would escape the store or reach a dotfile.
+func cleanName(name string) (string, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", os.ErrNotExist
+		}
+	}
+	return name, nil
+}
+
+// LocalStore lists a directory on disk. Dotfiles are skipped, as are
+// symlinks to folders or to anything outside Root.
+type LocalStore struct {
+	Root string
+}
+
+// inRoot reports whether p is still under Root once symlinks are followed.
+// A path that doesn't exist yet is judged by its nearest existing parent,
+// so writes can't go through a symlinked folder either.
+func (l LocalStore) inRoot(p string) bool {
+	root, err := filepath.EvalSymlinks(l.Root)
+	if err != nil {
+		return false
+	}
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			rel, err := filepath.Rel(root, resolved)
+			return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+		}
+		if !os.IsNotExist(err) {
+			return false
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return false
+		}
+		p = parent
+	}
+}
+
+// Overlaps reports whether Root is inside dir or dir is inside Root, once
+// symlinks are followed.
+func (l LocalStore) Overlaps(dir string) bool {
+	root, err := filepath.Abs(l.Root)
+	if err != nil {
+		return true
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return true
+	}
+	return LocalStore{Root: root}.inRoot(dir) || LocalStore{Root: dir}.inRoot(root)
+}
+
+func (l LocalStore) List() ([]Entry, error) {
+	var entries []Entry
+	seen := make(map[string]bool)
+
+	err := filepath.Walk(l.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(l.Root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !l.inRoot(path) {
+				return nil
+			}
+			// Walk doesn't follow links, so a linked folder would be
+			// listed as an empty file.
+			if info, err = os.Stat(path); err != nil || info.IsDir() {
+				return nil
+			}
+		}
+
+		entry := Entry{Path: filepath.ToSlash(rel), ModTime: info.ModTime()}
+		if info.IsDir() {
+			entry.Path += "/"
+		} else {
+			entry.Size = info.Size()
+			entry.Hash, entry.MIMEType, err = fileMeta(path, info)
+			if err != nil {
+				logging.Logger.Error("reading file metadata", "path", path, "err", err)
+			}
+			seen[path] = true
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err == nil {
+		forgetHashes(l.Root, seen)
+	}
+	return entries, err
+}
+
+func (l LocalStore) Open(name string) (io.ReadSeekCloser, Entry, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+
+	p := filepath.Join(l.Root, filepath.FromSlash(name))
+	if !l.inRoot(p) {
+		return nil, Entry{}, os.ErrNotExist
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, Entry{}, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, Entry{}, os.ErrNotExist
+	}
+	return f, Entry{Path: name, Size: info.Size(), ModTime: info.ModTime(), MIMEType: mimeByExt(name)}, nil
+}
+
+// S3Store lists a bucket on S3 or any S3 compatible service, such as minio,
+// when Endpoint is set. Only keys under Prefix are listed.
+type S3Store struct {
+	Bucket   string
+	Prefix   string
+	Endpoint string
+	Region   string
+
+	svc *s3.S3
+}
+
+func NewS3Store(bucket, prefix, endpoint, region string) (*S3Store, error) {
+	if region == "" {
+		region = "us-west-2"
+	}
+
+	cfg := &aws.Config{Region: aws.String(region)}
+	if endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &S3Store{Bucket: bucket, Prefix: prefix, Endpoint: endpoint, Region: region, svc: s3.New(sess)}, nil
+}
+
+func (s *S3Store) List() ([]Entry, error) {
+	var entries []Entry
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.Prefix),
+	}
+	err := s.svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			key := strings.TrimPrefix(aws.StringValue(obj.Key), s.Prefix)
+			if key == "" {
+				continue
+			}
+			entries = append(entries, Entry{
+				Path:     key,
+				Size:     aws.Int64Value(obj.Size),
+				ModTime:  aws.TimeValue(obj.LastModified),
+				ETag:     aws.StringValue(obj.ETag),
+				MIMEType: mimeByExt(key),
+				Hash:     strings.Trim(aws.StringValue(obj.ETag), `"`),
+			})
+		}
+		return true
+	})
+	return entries, err
+}
+
+func (s *S3Store) Open(name string) (io.ReadSeekCloser, Entry, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+
+	entry, err := s.head(name)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+	obj := &s3Object{store: s, key: s.Prefix + name, size: entry.Size}
+	return obj, entry, nil
+}
+
+// head looks up the object name, returning os.ErrNotExist if it's missing.
+func (s *S3Store) head(name string) (Entry, error) {
+	head, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Prefix + name),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == "NoSuchKey") {
+			return Entry{}, os.ErrNotExist
+		}
+		return Entry{}, err
+	}
+
+	return Entry{
+		Path:     name,
+		Size:     aws.Int64Value(head.ContentLength),
+		ModTime:  aws.TimeValue(head.LastModified),
+		ETag:     aws.StringValue(head.ETag),
+		MIMEType: aws.StringValue(head.ContentType),
+		Hash:     strings.Trim(aws.StringValue(head.ETag), `"`),
+	}, nil
+}
+
+// s3Object reads an object with ranged GETs, reopening the body whenever
+// the reader seeks, so range requests don't download the whole object.
+type s3Object struct {
+	store  *S3Store
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		out, err := o.store.svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(o.store.Bucket),
+			Key:    aws.String(o.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", o.offset)),
+		})
+		if err != nil {
+			return 0, err
+		}
+		o.body = out.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, fmt.Errorf("s3: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("s3: negative position")
+	}
+
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package tree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStoreSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "inside.txt"), filepath.Join(outside, "secret.txt")} {
+		if err := ioutil.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"secret.txt": filepath.Join(outside, "secret.txt"),
+		"out":        outside,
+		"alias.txt":  filepath.Join(root, "inside.txt"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+	}
+
+	store := LocalStore{Root: root}
+
+	entries, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]bool)
+	for _, entry := range entries {
+		listed[entry.Path] = true
+	}
+	for name, want := range map[string]bool{"inside.txt": true, "alias.txt": true, "secret.txt": false, "out": false, "out/": false} {
+		if listed[name] != want {
+			t.Errorf("List() includes %q = %v, want %v", name, listed[name], want)
+		}
+	}
+
+	for name, want := range map[string]bool{"inside.txt": true, "alias.txt": true, "secret.txt": false, "out/secret.txt": false} {
+		f, _, err := store.Open(name)
+		if err == nil {
+			f.Close()
+		}
+		if (err == nil) != want {
+			t.Errorf("Open(%q) err = %v, want success %v", name, err, want)
+		}
+	}
+
+	if err := store.Mkdir("out/new"); !os.IsNotExist(err) {
+		t.Errorf("Mkdir through a symlink err = %v, want not exist", err)
+	}
+}
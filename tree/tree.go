@@ -1,29 +1,140 @@
 package tree
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"path"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dedgarsites/dedgar/logging"
 )
 
 var (
-	startPath  = "/"
-	RootFolder = newFolder(startPath)
+	startPath = "/"
+
+	// ErrNotFound is returned by Resolve for paths that aren't in the tree.
+	ErrNotFound = errors.New("not found in tree")
+
+	// DefaultStore is where the tree is read from: the S3 bucket named by
+	// TREE_BUCKET if set, otherwise the directory TREE_ROOT.
+	DefaultStore Store
+	// RefreshInterval is how often Watch rebuilds the tree, set with
+	// TREE_REFRESH.
+	RefreshInterval = 5 * time.Minute
+	// initialRetry is how long Watch waits between attempts at the first
+	// listing.
+	initialRetry = 10 * time.Second
+
+	// mu guards rootFolder and generation. The tree itself is never
+	// modified once it's been swapped in, so readers only need the lock to
+	// fetch it.
+	mu         sync.RWMutex
+	rootFolder = newFolder(startPath)
+	// generation counts edits, so Refresh can tell when one happened while
+	// it was listing the store.
+	generation uint64
+	// loaded is set once the first Refresh has succeeded.
+	loaded int32
 )
 
 type File struct {
-	//Id   string
-	Name string
+	// ID is derived from the path, so it stays the same across refreshes.
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Path is relative to the root of the store, e.g. "test3/inside.jpg".
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	MIMEType string    `json:"mime_type"`
+	// Hash is the hex SHA-256 of the contents for local files, or the
+	// object's ETag for S3.
+	Hash string `json:"hash"`
 }
 
 type Folder struct {
-	Name    string
-	Files   []File
-	Folders map[string]*Folder
+	ID      string             `json:"id"`
+	Name    string             `json:"name"`
+	Path    string             `json:"path"`
+	Files   []File             `json:"-"`
+	Folders map[string]*Folder `json:"-"`
+	// Size is the total size of everything under the folder and ModTime the
+	// newest modification time found there.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// FileCount and FolderCount count direct children only.
+	FileCount   int `json:"file_count"`
+	FolderCount int `json:"folder_count"`
 }
 
 func newFolder(name string) *Folder {
-	return &Folder{name, []File{}, make(map[string]*Folder)}
+	return &Folder{ID: pathID(""), Name: name, Files: []File{}, Folders: make(map[string]*Folder)}
+}
+
+func pathID(p string) string {
+	sum := sha1.Sum([]byte(p))
+	return hex.EncodeToString(sum[:8])
+}
+
+// HumanSize formats the file size for listings.
+func (f File) HumanSize() string {
+	return humanSize(f.Size)
+}
+
+// HumanSize formats the folder's total size for listings.
+func (f *Folder) HumanSize() string {
+	return humanSize(f.Size)
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// IsImage reports whether the file is an image.
+func (f File) IsImage() bool {
+	return strings.HasPrefix(f.MIMEType, "image/")
+}
+
+// IsVideo reports whether the file is a video.
+func (f File) IsVideo() bool {
+	return strings.HasPrefix(f.MIMEType, "video/")
+}
+
+// HasMedia reports whether any of the folder's files are images or videos.
+func (f *Folder) HasMedia() bool {
+	for _, file := range f.Files {
+		if file.IsImage() || file.IsVideo() {
+			return true
+		}
+	}
+	return false
+}
+
+// EscapedPath returns the file's path escaped for use in a URL.
+func (f File) EscapedPath() string {
+	return (&url.URL{Path: f.Path}).EscapedPath()
+}
+
+// EscapedPath returns the folder's path escaped for use in a URL.
+func (f *Folder) EscapedPath() string {
+	return (&url.URL{Path: f.Path}).EscapedPath()
 }
 
 func (f *Folder) getFolder(name string) *Folder {
@@ -47,37 +158,232 @@ func (f *Folder) existFolder(name string) bool {
 
 func (f *Folder) addFolder(folderName string) {
 	if !f.existFolder(folderName) {
-		f.Folders[folderName] = newFolder(folderName)
+		folder := newFolder(folderName)
+		folder.Path = f.Path + folderName + "/"
+		folder.ID = pathID(folder.Path)
+		f.Folders[folderName] = folder
 	}
 }
 
-func (f *Folder) addFile(fileName string) {
-	f.Files = append(f.Files, File{fileName})
+func (f *Folder) addFile(fileName string, entry Entry) {
+	filePath := f.Path + fileName
+	f.Files = append(f.Files, File{
+		ID:       pathID(filePath),
+		Name:     fileName,
+		Path:     filePath,
+		Size:     entry.Size,
+		ModTime:  entry.ModTime,
+		MIMEType: entry.MIMEType,
+		Hash:     entry.Hash,
+	})
+}
+
+// summarize fills in the aggregate size, modification time and child counts
+// of f and every folder below it.
+func (f *Folder) summarize() {
+	f.Size = 0
+	f.ModTime = time.Time{}
+	f.FileCount = len(f.Files)
+	f.FolderCount = len(f.Folders)
+
+	sort.Slice(f.Files, func(i, j int) bool {
+		return NaturalLess(f.Files[i].Name, f.Files[j].Name)
+	})
+
+	for _, file := range f.Files {
+		f.Size += file.Size
+		if file.ModTime.After(f.ModTime) {
+			f.ModTime = file.ModTime
+		}
+	}
+	for _, folder := range f.Folders {
+		folder.summarize()
+		f.Size += folder.Size
+		if folder.ModTime.After(f.ModTime) {
+			f.ModTime = folder.ModTime
+		}
+	}
 }
 
-func (f *Folder) getList() (result []map[string]interface{}) {
+// Resolve walks name from f one segment at a time, matching names exactly.
+// It returns either the folder or the file that name refers to, or
+// ErrNotFound. A file can only be the last segment.
+func (f *Folder) Resolve(name string) (*Folder, *File, error) {
+	folder := f
+	segments := DeleteEmptyElements(strings.Split(name, "/"))
+
+	for i, segment := range segments {
+		if next, ok := folder.Folders[segment]; ok {
+			folder = next
+			continue
+		}
+		if i == len(segments)-1 {
+			for j := range folder.Files {
+				if folder.Files[j].Name == segment {
+					return nil, &folder.Files[j], nil
+				}
+			}
+		}
+		return nil, nil, ErrNotFound
+	}
+	return folder, nil, nil
+}
+
+// Subfolders returns the folder's direct subfolders in natural order.
+func (f *Folder) Subfolders() []*Folder {
+	folders := make([]*Folder, 0, len(f.Folders))
 	for _, v := range f.Folders {
-		result = append(result, map[string]interface{}{
-			"name": v.Name,
-			"type": "folder",
-		})
+		folders = append(folders, v)
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		return NaturalLess(folders[i].Name, folders[j].Name)
+	})
+	return folders
+}
+
+// Crumb is one step of the path from the root to a folder.
+type Crumb struct {
+	Name string
+	Path string
+}
+
+// EscapedPath returns the crumb's path escaped for use in a URL.
+func (c Crumb) EscapedPath() string {
+	return (&url.URL{Path: c.Path}).EscapedPath()
+}
+
+// Breadcrumbs returns the trail from the root down to f, root first and f
+// last.
+func (f *Folder) Breadcrumbs() []Crumb {
+	crumbs := []Crumb{{Name: "all"}}
+	p := ""
+	for _, segment := range DeleteEmptyElements(strings.Split(f.Path, "/")) {
+		p += segment + "/"
+		crumbs = append(crumbs, Crumb{Name: segment, Path: p})
+	}
+	return crumbs
+}
+
+// Parent returns the crumb for the folder containing f, or nil at the root.
+func (f *Folder) Parent() *Crumb {
+	crumbs := f.Breadcrumbs()
+	if len(crumbs) < 2 {
+		return nil
+	}
+	return &crumbs[len(crumbs)-2]
+}
+
+// Item is a file or folder as listed by the JSON API.
+type Item struct {
+	Type        string    `json:"type"`
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mtime"`
+	MIMEType    string    `json:"mime_type,omitempty"`
+	Hash        string    `json:"hash,omitempty"`
+	FileCount   int       `json:"file_count,omitempty"`
+	FolderCount int       `json:"folder_count,omitempty"`
+	Children    []Item    `json:"children,omitempty"`
+}
+
+// ListOptions controls Folder.List. Sort is "name", "size" or "mtime".
+// Offset and Limit page through the folder's direct children; a Limit of
+// zero returns all of them. Depth is how many levels of children to nest
+// under each subfolder.
+type ListOptions struct {
+	Sort   string
+	Desc   bool
+	Offset int
+	Limit  int
+	Depth  int
+}
+
+// SortKeys are the values accepted for ListOptions.Sort.
+var SortKeys = []string{"name", "size", "mtime"}
+
+func (f *Folder) Item() Item {
+	return Item{
+		Type:        "folder",
+		ID:          f.ID,
+		Name:        f.Name,
+		Path:        f.Path,
+		Size:        f.Size,
+		ModTime:     f.ModTime,
+		FileCount:   f.FileCount,
+		FolderCount: f.FolderCount,
+	}
+}
+
+func (f File) Item() Item {
+	return Item{
+		Type:     "file",
+		ID:       f.ID,
+		Name:     f.Name,
+		Path:     f.Path,
+		Size:     f.Size,
+		ModTime:  f.ModTime,
+		MIMEType: f.MIMEType,
+		Hash:     f.Hash,
+	}
+}
+
+// List returns a page of f's children, folders before files, along with the
+// total number of children.
+func (f *Folder) List(opts ListOptions) ([]Item, int) {
+	items := f.children(opts.Sort, opts.Desc, opts.Depth)
+	total := len(items)
+
+	if opts.Offset > total {
+		opts.Offset = total
 	}
+	items = items[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(items) {
+		items = items[:opts.Limit]
+	}
+	return items, total
+}
 
+func (f *Folder) children(sortBy string, desc bool, depth int) []Item {
+	var folders, files []Item
+	for _, v := range f.Folders {
+		item := v.Item()
+		if depth > 0 {
+			item.Children = v.children(sortBy, desc, depth-1)
+		}
+		folders = append(folders, item)
+	}
 	for _, v := range f.Files {
-		result = append(result, map[string]interface{}{
-			//"id":   v.Id,
-			"name": v.Name,
-			"type": "file",
-		})
+		files = append(files, v.Item())
 	}
-	return
+
+	sortItems(folders, sortBy, desc)
+	sortItems(files, sortBy, desc)
+	return append(folders, files...)
 }
 
-func isFile(str string) bool {
-	if path.Ext(str) != "" {
-		return true
+func sortItems(items []Item, sortBy string, desc bool) {
+	less := func(a, b Item) bool {
+		switch sortBy {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return NaturalLess(a.Name, b.Name)
 	}
-	return false
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if desc {
+			return less(items[j], items[i])
+		}
+		return less(items[i], items[j])
+	})
 }
 
 func DeleteEmptyElements(s []string) []string {
@@ -90,164 +396,127 @@ func DeleteEmptyElements(s []string) []string {
 	return r
 }
 
-type IS map[string]string
+// Build assembles a folder tree from the entries of a store.
+func Build(entries []Entry) *Folder {
+	root := newFolder(startPath)
 
-func init() {
-	arrayPaths := []interface{}{
-		IS{
-			"id":       "1",
-			"filePath": "all/",
-		},
-		IS{
-			"id":       "1",
-			"filePath": "all/peelz.here",
-		},
-		IS{
-			"id":       "2",
-			"filePath": "all/test1/",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test1/Nene_noises_for_1_32_minutes.mp4",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test1/neptune_all_the_meme.jpg",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test2/",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test2/america_chan_seijouki.png",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test2/bongo_cat_levan_polka_miku.mp4",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test3/",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test3/inside_test3.jpg",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test3/test4/",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test3/test4/second_level.jpg",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test3/test4/another_s2.mp3",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test3/test4/test5/",
-		},
-		IS{
-			"id":       "3",
-			"filePath": "all/test3/test4/test5/test6/",
-		},
-	}
-
-	breadcrumb := "all/"
-
-	for _, path := range arrayPaths {
-		filePath := path.(IS)["filePath"]
-		//fileId := path.(IS)["id"]
-		splitPath := DeleteEmptyElements(strings.Split(filePath, "/"))
-		tmpFolder := RootFolder
-		for _, item := range splitPath {
-			if isFile(item) {
-				tmpFolder.addFile(item) //, fileId)
+	for _, entry := range entries {
+		splitPath := DeleteEmptyElements(strings.Split(entry.Path, "/"))
+		tmpFolder := root
+		for i, item := range splitPath {
+			if i == len(splitPath)-1 && !strings.HasSuffix(entry.Path, "/") {
+				tmpFolder.addFile(item, entry)
 			} else {
-				if item != startPath {
-					tmpFolder.addFolder(item)
-				}
+				tmpFolder.addFolder(item)
 				tmpFolder = tmpFolder.getFolder(item)
 			}
 		}
 	}
+	root.summarize()
+	return root
+}
 
-	currentFolder := RootFolder.getFolder("/")
-	breadcrumbElements := DeleteEmptyElements(strings.Split(breadcrumb, "/"))
-	for i, v := range breadcrumbElements {
-		if currentFolder.existFolder(v) {
-			currentFolder = currentFolder.getFolder(v)
-			if i == len(breadcrumbElements)-1 {
-				break
-			}
-		} else {
-			currentFolder = currentFolder.getFolder(v)
-		}
+// Root returns the most recently built tree. It's a snapshot: edits and
+// refreshes replace it rather than changing it, so it's safe to walk from
+// any goroutine but must not be modified.
+func Root() *Folder {
+	mu.RLock()
+	defer mu.RUnlock()
+	return rootFolder
+}
+
+// Refresh rebuilds the tree from DefaultStore. If the tree is edited while
+// the store is being listed, the listing may predate the edit, so it's
+// thrown away and the tree is left as the edit made it.
+func Refresh() error {
+	mu.RLock()
+	start := generation
+	mu.RUnlock()
+
+	entries, err := DefaultStore.List()
+	if err != nil {
+		return err
 	}
-	//fmt.Println(currentFolder.getList())
-	//printDir(RootFolder)
+
+	root := Build(entries)
+
+	mu.Lock()
+	if generation == start {
+		rootFolder = root
+	}
+	mu.Unlock()
+	atomic.StoreInt32(&loaded, 1)
+	return nil
+}
+
+// Loaded reports whether the tree has been listed from the store yet.
+func Loaded() bool {
+	return atomic.LoadInt32(&loaded) == 1
 }
 
-func printDir(RootFolder *Folder) {
-	fmt.Println("In folder: ", RootFolder.Name)
-	fmt.Println(RootFolder.Files)
-	/*if RootFolder.Folders != nil {
-		for _, fol := range RootFolder.Folders {
-			fmt.Println(fol.Name)
+// Watch builds the tree, retrying every few seconds until the store can be
+// listed, then refreshes it every interval until ctx is cancelled. The tree
+// is empty until the first listing finishes, which for a large store can
+// take a while since local files are hashed.
+func Watch(ctx context.Context, interval time.Duration) {
+	for {
+		err := Refresh()
+		if err == nil {
+			break
 		}
-	}*/
+		logging.Logger.Error("building file tree", "err", err)
 
-	if len(RootFolder.Folders) > 0 {
-		for _, folder := range RootFolder.Folders {
-			fmt.Printf("found nested folder: %+v", folder)
-			printDir(folder)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(initialRetry):
 		}
 	}
-	//fmt.Println(RootFolder.Name)
-}
 
-func FindObj(rootFolder *Folder, findItem string, fChan chan *Folder, eChan chan bool) {
-	fmt.Println("In folder: ", rootFolder.Name)
-	select {
-	case <-eChan:
-		return
-	case folderChan := <-fChan:
-		fmt.Println("returning", folderChan.Name)
-		eChan <- true
-		return
-	default:
-	}
-	if rootFolder.Name == findItem {
-		fmt.Println("this is already what we're looking for")
-		fChan <- rootFolder
-		return
-	}
-	for _, folder := range rootFolder.Folders {
-		if folder.Name == findItem {
-			fmt.Printf("one of the folders in %v is what we're looking for\n", rootFolder.Name)
-			fChan <- folder
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
+			if err := Refresh(); err != nil {
+				logging.Logger.Error("refreshing file tree", "err", err)
+			}
+			ExpireUploads()
 		}
-		go FindObj(folder, findItem, fChan, eChan)
 	}
 }
 
-func FindNode(rootFolder *Folder, findItem string) *Folder {
-	found := newFolder("")
+// defaultRoot is where the tree's files are kept without TREE_ROOT: next to
+// the site's static directory rather than in it, since everything in there
+// is served to anyone.
+func defaultRoot(sitePath string) string {
+	return filepath.Join(sitePath, "files")
+}
 
-	if rootFolder.Name == findItem {
-		return rootFolder
+func init() {
+	if interval, err := time.ParseDuration(os.Getenv("TREE_REFRESH")); err == nil && interval > 0 {
+		RefreshInterval = interval
 	}
 
-	for _, folder := range rootFolder.Folders {
-		if folder.Name == findItem {
-			return folder
+	if bucket := os.Getenv("TREE_BUCKET"); bucket != "" {
+		store, err := NewS3Store(bucket, os.Getenv("TREE_PREFIX"), os.Getenv("TREE_ENDPOINT"), os.Getenv("TREE_REGION"))
+		if err != nil {
+			logging.Logger.Error("creating S3 store, falling back to local files", "bucket", bucket, "err", err)
+		} else {
+			DefaultStore = store
 		}
-		found = FindNode(folder, findItem)
 	}
-
-	return found
+	if DefaultStore == nil {
+		root := os.Getenv("TREE_ROOT")
+		if root == "" {
+			root = defaultRoot(os.Getenv("SITE_PATH"))
+			if err := os.MkdirAll(root, 0755); err != nil {
+				logging.Logger.Error("creating tree root", "root", root, "err", err)
+			}
+		}
+		DefaultStore = LocalStore{Root: root}
+	}
 }
@@ -0,0 +1,116 @@
+package tree
+
+import (
+	"context"
+	"testing"
+)
+
+func testTree() *Folder {
+	return Build([]Entry{
+		{Path: "readme.txt", Size: 1},
+		{Path: "photos/2019/beach.jpg", Size: 2},
+		{Path: "photos/2019/trip/day one/beach.jpg", Size: 3},
+		{Path: "photos/2020/beach.jpg", Size: 4},
+		{Path: "docs/readme.txt", Size: 5},
+		{Path: "a/b/c/d/e/f/g/deep.txt", Size: 6},
+		{Path: "empty/"},
+	})
+}
+
+func TestResolve(t *testing.T) {
+	root := testTree()
+
+	tests := []struct {
+		name string
+		// Exactly one of folder, file and missing describes the result:
+		// the canonical path of the folder found, the path of the file
+		// found, or ErrNotFound.
+		folder  string
+		file    string
+		missing bool
+		// redirect is whether a folder was asked for by other than its
+		// canonical path, which the handlers redirect to.
+		redirect bool
+	}{
+		{name: "", folder: "/"},
+		{name: "/", folder: "/", redirect: true},
+		{name: "readme.txt", file: "readme.txt"},
+		{name: "docs/readme.txt", file: "docs/readme.txt"},
+
+		// The same name in different folders resolves to different files.
+		{name: "photos/2019/beach.jpg", file: "photos/2019/beach.jpg"},
+		{name: "photos/2020/beach.jpg", file: "photos/2020/beach.jpg"},
+		{name: "photos/2019/trip/day one/beach.jpg", file: "photos/2019/trip/day one/beach.jpg"},
+
+		{name: "a/b/c/d/e/f/g/deep.txt", file: "a/b/c/d/e/f/g/deep.txt"},
+		{name: "a/b/c/d/e/f/g/", folder: "a/b/c/d/e/f/g/"},
+		{name: "empty/", folder: "empty/"},
+
+		// Folders are found without their trailing slash or with extra
+		// slashes, but the handlers redirect to the canonical path.
+		{name: "photos", folder: "photos/", redirect: true},
+		{name: "photos/2019", folder: "photos/2019/", redirect: true},
+		{name: "/photos/2019/", folder: "photos/2019/", redirect: true},
+		{name: "photos//2019///trip", folder: "photos/2019/trip/", redirect: true},
+		{name: "a/b/c/d/e/f/g", folder: "a/b/c/d/e/f/g/", redirect: true},
+
+		// A trailing slash on a file still finds the file.
+		{name: "docs/readme.txt/", file: "docs/readme.txt"},
+
+		{name: "missing", missing: true},
+		{name: "missing/", missing: true},
+		{name: "photos/2021/beach.jpg", missing: true},
+		{name: "photos/beach.jpg", missing: true},
+		{name: "docs/readme.txt/more", missing: true},
+		{name: "readme.txt/docs", missing: true},
+		{name: "Photos/2019/beach.jpg", missing: true},
+		{name: "photos/2019/trip/day one/missing.jpg", missing: true},
+		{name: "a/b/c/d/e/f/deep.txt", missing: true},
+	}
+
+	for _, tt := range tests {
+		folder, file, err := root.Resolve(tt.name)
+
+		switch {
+		case tt.missing:
+			if err != ErrNotFound {
+				t.Errorf("Resolve(%q) = %v, %v, %v; want ErrNotFound", tt.name, folder, file, err)
+			}
+		case tt.file != "":
+			if err != nil || file == nil {
+				t.Errorf("Resolve(%q) = %v, %v, %v; want file %q", tt.name, folder, file, err, tt.file)
+			} else if file.Path != tt.file {
+				t.Errorf("Resolve(%q) file path = %q, want %q", tt.name, file.Path, tt.file)
+			}
+		default:
+			if err != nil || folder == nil {
+				t.Errorf("Resolve(%q) = %v, %v, %v; want folder %q", tt.name, folder, file, err, tt.folder)
+				continue
+			}
+			path := folder.Path
+			if path == "" {
+				path = "/"
+			}
+			if path != tt.folder {
+				t.Errorf("Resolve(%q) folder path = %q, want %q", tt.name, path, tt.folder)
+			}
+			if redirect := tt.name != folder.Path; redirect != tt.redirect {
+				t.Errorf("Resolve(%q) redirect = %v, want %v", tt.name, redirect, tt.redirect)
+			}
+		}
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	root := testTree()
+
+	for i := 0; i < 20; i++ {
+		items, err := root.Search(context.Background(), SearchOptions{Pattern: "beach", Limit: 2, Workers: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 2 || items[0].Path != "photos/2019/beach.jpg" || items[1].Path != "photos/2019/trip/day one/beach.jpg" {
+			t.Fatalf("Search limited to 2 = %v", items)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ErrReadOnly is returned when editing a tree whose store can't be written.
+var ErrReadOnly = errors.New("file tree is read-only")
+
+// WritableStore is a Store that can also be edited. Names are slash
+// separated paths relative to the root of the store. Move and Delete work
+// on both files and folders, folders taking everything under them along.
+type WritableStore interface {
+	Store
+	Put(name string, r io.ReadSeeker) (Entry, error)
+	Mkdir(name string) error
+	Move(from, to string) error
+	Delete(name string) error
+}
+
+var (
+	_ WritableStore = LocalStore{}
+	_ WritableStore = (*S3Store)(nil)
+)
+
+// writableName is cleanName for edits, which can't target the root.
+func writableName(name string) (string, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", os.ErrInvalid
+	}
+	return name, nil
+}
+
+func (l LocalStore) path(name string) (string, error) {
+	name, err := writableName(name)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(l.Root, filepath.FromSlash(name))
+	if !l.inRoot(p) {
+		return "", os.ErrNotExist
+	}
+	return p, nil
+}
+
+// Put writes r to a temporary file next to name and renames it into place,
+// so readers never see a partial upload.
+func (l LocalStore) Put(name string, r io.ReadSeeker) (Entry, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return Entry{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return Entry{}, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return Entry{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return Entry{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Entry{}, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return Entry{}, err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return Entry{}, err
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry := Entry{Path: name, Size: info.Size(), ModTime: info.ModTime()}
+	entry.Hash, entry.MIMEType, err = fileMeta(p, info)
+	return entry, err
+}
+
+func (l LocalStore) Mkdir(name string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0755)
+}
+
+func (l LocalStore) Move(from, to string) error {
+	src, err := l.path(from)
+	if err != nil {
+		return err
+	}
+	dst, err := l.path(to)
+	if err != nil {
+		return err
+	}
+
+	// Rename would silently replace an existing file.
+	if _, err := os.Lstat(dst); err == nil {
+		return os.ErrExist
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+func (l LocalStore) Delete(name string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(p); err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (s *S3Store) Put(name string, r io.ReadSeeker) (Entry, error) {
+	name, err := writableName(name)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	_, err = s.svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(s.Prefix + name),
+		ContentType: aws.String(mimeByExt(name)),
+		Body:        r,
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+	return s.head(name)
+}
+
+// Mkdir stores an empty "name/" marker object, which is how the S3 console
+// creates folders too, so empty folders survive a refresh.
+func (s *S3Store) Mkdir(name string) error {
+	name, err := writableName(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Prefix + name + "/"),
+		Body:   bytes.NewReader(nil),
+	})
+	return err
+}
+
+// Move copies every object under from to its new key and then deletes the
+// originals. S3 has no rename, so a move that fails partway can leave
+// objects in both places; the copies are made first so nothing is lost.
+func (s *S3Store) Move(from, to string) error {
+	from, err := writableName(from)
+	if err != nil {
+		return err
+	}
+	to, err = writableName(to)
+	if err != nil {
+		return err
+	}
+
+	existing, err := s.keys(to)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(existing) > 0 {
+		return os.ErrExist
+	}
+
+	keys, err := s.keys(from)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		_, err := s.svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(s.Bucket),
+			Key:        aws.String(s.Prefix + to + strings.TrimPrefix(key, from)),
+			CopySource: aws.String(url.PathEscape(s.Bucket) + "/" + (&url.URL{Path: s.Prefix + key}).EscapedPath()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.deleteKeys(keys)
+}
+
+func (s *S3Store) Delete(name string) error {
+	name, err := writableName(name)
+	if err != nil {
+		return err
+	}
+
+	keys, err := s.keys(name)
+	if err != nil {
+		return err
+	}
+	return s.deleteKeys(keys)
+}
+
+// keys returns the keys, without the store prefix, of the object name or of
+// everything in the folder name.
+func (s *S3Store) keys(name string) ([]string, error) {
+	var keys []string
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.Prefix + name + "/"),
+	}
+	err := s.svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(obj.Key), s.Prefix))
+		}
+		return true
+	})
+	if err != nil || len(keys) > 0 {
+		return keys, err
+	}
+
+	if _, err := s.head(name); err != nil {
+		return nil, err
+	}
+	return []string{name}, nil
+}
+
+func (s *S3Store) deleteKeys(keys []string) error {
+	for _, key := range keys {
+		_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(s.Prefix + key),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parentName returns the folder part of a slash separated name, or "" for
+// names at the root.
+func parentName(name string) string {
+	dir := path.Dir(name)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
@@ -0,0 +1,53 @@
+package tree
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestUploadsNotPublic(t *testing.T) {
+	site, err := ioutil.TempDir("", "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(site)
+
+	static := filepath.Join(site, "static")
+	if err := os.Mkdir(static, 0755); err != nil {
+		t.Fatal(err)
+	}
+	store := LocalStore{Root: defaultRoot(site)}
+	if err := os.Mkdir(store.Root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if store.Overlaps(static) {
+		t.Fatalf("default root %q overlaps %q", store.Root, static)
+	}
+	if _, err := store.Put("up/evil.html", strings.NewReader("<script>alert(1)</script>")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Served the way the routers serve the site's static files.
+	e := echo.New()
+	e.Static("/", static)
+	for _, target := range []string{"/up/evil.html", "/files/up/evil.html", "/../files/up/evil.html", "/%2e%2e/files/up/evil.html"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code == http.StatusOK || strings.Contains(rec.Body.String(), "<script>") {
+			t.Errorf("GET %s = %d %q, want the upload not served", target, rec.Code, rec.Body.String())
+		}
+	}
+
+	for _, root := range []string{static, filepath.Join(static, "media"), site} {
+		if !(LocalStore{Root: root}).Overlaps(static) {
+			t.Errorf("root %q doesn't overlap %q", root, static)
+		}
+	}
+}